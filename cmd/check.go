@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/spf13/cobra"
+)
+
+var checkConfigFile string
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the config file and its flows without connecting to SignalFx",
+	Run: func(cmd *cobra.Command, args []string) {
+		checks, err := config.CheckConfig(checkConfigFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %s\n", checkConfigFile, err)
+			os.Exit(1)
+		}
+		failed := 0
+		for _, check := range checks {
+			if check.Err != nil {
+				fmt.Printf("FAIL %s: %s\n", check.Name, check.Err)
+				failed++
+			} else {
+				fmt.Printf("PASS %s\n", check.Name)
+			}
+		}
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d flows failed\n", failed, len(checks))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().StringVarP(&checkConfigFile, "config", "c", "/config/config.yml", "flow config file")
+}
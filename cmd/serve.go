@@ -1,29 +1,49 @@
 package cmd
 
 import (
+	"os"
+	"os/signal"
 	"signalfx-prometheus-exporter/serve"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
-var (
-	// cli flags
-	listenPort        int
-	observabilityPort int
-	configFile        string
-)
+// cli flags
+var options serve.Options
 
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Listen for signalfx scrape requests",
 	Run: func(cmd *cobra.Command, args []string) {
-		serve.CollectoAndServe(configFile, listenPort, observabilityPort, cmd.Context())
+		// SIGHUP reloads the flows of the config
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		options.ReloadSignals = reload
+		serve.CollectoAndServe(options, cmd.Context())
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(serveCmd)
-	serveCmd.Flags().IntVarP(&listenPort, "port", "l", 9091, "listen port for incoming scrape requests")
-	serveCmd.Flags().StringVarP(&configFile, "config", "c", "/config/config.yml", "flow config file")
-	serveCmd.Flags().IntVarP(&observabilityPort, "observability-port", "p", 9090, "port for expoerter self observability")
+	serveCmd.Flags().IntVarP(&options.ListenPort, "port", "l", 9091, "listen port for incoming scrape requests")
+	serveCmd.Flags().StringVarP(&options.ConfigFile, "config", "c", "/config/config.yml", "flow config file")
+	serveCmd.Flags().DurationVar(&options.ConfigWait, "config-wait", 0, "wait this long for the config file to appear and be non-empty, e.g. a late volume mount, 0 fails right away")
+	serveCmd.Flags().DurationVar(&options.ConfigWaitInterval, "config-wait-interval", time.Second, "how often to check for the config file while waiting for it")
+	serveCmd.Flags().IntVarP(&options.ObservabilityPort, "observability-port", "p", 9090, "port for expoerter self observability")
+	serveCmd.Flags().DurationVar(&options.GatherCacheTTL, "gather-cache-ttl", 0, "serve scrapes from a cached gather for this long, 0 disables caching")
+	serveCmd.Flags().DurationVar(&options.ExpositionRefreshInterval, "exposition-refresh-interval", 0, "serialize metrics in the background on this interval and serve scrapes from the result, 0 disables the exposition cache, excludes --gather-cache-ttl")
+	serveCmd.Flags().BoolVar(&options.ObservabilityOptional, "observability-optional", false, "keep serving scrapes when the observability server can't listen on its port")
+	serveCmd.Flags().IntVar(&options.MaxConcurrentProbes, "max-concurrent-probes", 0, "reject grouping probe scrapes beyond this many concurrent ones with 503, 0 means unlimited")
+	serveCmd.Flags().DurationVar(&options.ScrapeTimeout, "scrape-timeout", 5*time.Second, "timeout of scrapes that don't send the X-Prometheus-Scrape-Timeout-Seconds header")
+	serveCmd.Flags().StringVar(&options.NoFlows, "no-flows", serve.NoFlowsWarn, "behavior for a config without flows, one of warn, fail to exit or unready to report not ready")
+	serveCmd.Flags().BoolVar(&options.FailFast, "fail-fast", false, "stop the exporter when a single flow fails for good, e.g. because of a rejected token, instead of serving the other flows")
+	serveCmd.Flags().StringVar(&options.DumpBearerToken, "dump-token", "", "bearer token required for series dumps on the observability port, /-/dump is disabled without one")
+	serveCmd.Flags().DurationVar(&options.ReadyGracePeriod, "ready-grace-period", 0, "report ready this long after startup even if some flows received no data yet, e.g. flows with sparse data, 0 waits for all flows")
+	serveCmd.Flags().StringVar(&options.TLSCert, "tls-cert", "", "certificate file to serve scrapes and the observability endpoints over https, requires --tls-key")
+	serveCmd.Flags().StringVar(&options.TLSKey, "tls-key", "", "private key file of the --tls-cert certificate")
+	serveCmd.Flags().StringVar(&options.TLSClientCA, "tls-client-ca", "", "CA file to require and verify client certificates on the scrape port, i.e. mutual TLS")
+	serveCmd.Flags().BoolVar(&options.WatchConfig, "watch-config", false, "reload the flows of the config file when it changes, e.g. an updated kubernetes ConfigMap, like on SIGHUP")
 }
@@ -2,11 +2,21 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"math"
+	"os"
+	"strings"
 	"text/template"
 	"time"
 
+	"signalfx-prometheus-exporter/version"
+
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,17 +30,59 @@ type Grouping struct {
 }
 
 type PrometheusMetric struct {
-	Name           string            `yaml:"name"`
-	Stream         string            `yaml:"stream"`
-	Type           string            `yaml:"type"`
-	Labels         map[string]string `yaml:"labels"`
-	nameTemplate   template.Template
-	labelTemplates map[string]template.Template
+	Name              string              `yaml:"name"`
+	Help              string              `yaml:"help"`
+	Stream            string              `yaml:"stream"`
+	Type              string              `yaml:"type"`
+	Labels            map[string]string   `yaml:"labels"`
+	MinUpdateInterval time.Duration       `yaml:"minUpdateInterval"`
+	Increment         string              `yaml:"increment"`
+	Transform         string              `yaml:"transform"`
+	Scale             *float64            `yaml:"scale"`
+	Offset            float64             `yaml:"offset"`
+	Cumulative        bool                `yaml:"cumulative"`
+	InitialValue      string              `yaml:"initialValue"`
+	AggregateWithout  []string            `yaml:"aggregateWithout"`
+	When              string              `yaml:"when"`
+	ExportMetadata    bool                `yaml:"exportMetadata"`
+	Buckets           []float64           `yaml:"buckets"`
+	Objectives        map[float64]float64 `yaml:"objectives"`
+	MaxAge            time.Duration       `yaml:"maxAge"`
+	StaleAfter        time.Duration       `yaml:"staleAfter"`
+	nameTemplate      template.Template
+	helpTemplate      *template.Template
+	labelTemplates    map[string]template.Template
+	incrementTemplate *template.Template
+	transformTemplate *template.Template
+	whenTemplate      *template.Template
 }
 
+// the types a metric template can raise
+var metricTypes = map[string]struct{}{"counter": {}, "gauge": {}, "histogram": {}, "summary": {}}
+
+// DefaultSummaryObjectives are the quantiles of summaries without objectives, with their allowed error
+var DefaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+const (
+	// DefaultReconnectBackoff is the wait before the first reconnect of a flow, doubling with every further one
+	DefaultReconnectBackoff = time.Second
+	// DefaultMaxReconnectBackoff is the longest wait between reconnects of a flow
+	DefaultMaxReconnectBackoff = time.Minute
+	// DefaultStableStreamDuration is how long a stream has to run to reset the reconnect backoff
+	DefaultStableStreamDuration = time.Minute
+)
+
+const (
+	// InitialValueZero starts cumulative counters at 0, the first total is the baseline
+	InitialValueZero = "zero"
+	// InitialValueFirst starts cumulative counters at the first total
+	InitialValueFirst = "first"
+)
+
 type NameTemplateVars struct {
 	SignalFxMetricName string
 	SignalFxLabels     map[string]string
+	SignalFxInternal   map[string]string
 }
 
 func (pm *PrometheusMetric) Validate() error {
@@ -44,10 +96,28 @@ func (pm *PrometheusMetric) Validate() error {
 		return err
 	}
 	pm.nameTemplate = *tmpl
+	// static names can be checked right away
+	if !strings.Contains(name, "{{") {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return fmt.Errorf("Invalid metric name %q", name)
+		}
+	}
+
+	// help template
+	if pm.Help != "" {
+		tmpl, err := template.New("x").Parse(pm.Help)
+		if err != nil {
+			return err
+		}
+		pm.helpTemplate = tmpl
+	}
 
 	// label templates
 	labelTemplates := map[string]template.Template{}
 	for labelName, labelValue := range pm.Labels {
+		if !model.LabelName(labelName).IsValid() {
+			return fmt.Errorf("Invalid label name %q", labelName)
+		}
 		tmpl, err := template.New("x").Parse(labelValue)
 		if err != nil {
 			return err
@@ -56,15 +126,153 @@ func (pm *PrometheusMetric) Validate() error {
 	}
 	pm.labelTemplates = labelTemplates
 
+	if pm.MinUpdateInterval < 0 {
+		return fmt.Errorf("minUpdateInterval must be positive, got %v", pm.MinUpdateInterval)
+	}
+	if pm.StaleAfter < 0 {
+		return fmt.Errorf("staleAfter must be positive, got %v", pm.StaleAfter)
+	}
+
+	// increment template
+	if pm.Increment != "" {
+		if pm.Type != "counter" {
+			return fmt.Errorf("increment is only supported for counters, got %s", pm.Type)
+		}
+		tmpl, err := parseValueTemplate(pm.Increment)
+		if err != nil {
+			return err
+		}
+		pm.incrementTemplate = tmpl
+		// constant increments can be checked right away
+		if !strings.Contains(pm.Increment, "{{") {
+			if _, err := pm.GetIncrement(NameTemplateVars{}, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	// cumulative counters
+	if pm.Cumulative {
+		if pm.Type != "counter" {
+			return fmt.Errorf("cumulative is only supported for counters, got %s", pm.Type)
+		}
+		if pm.Increment != "" {
+			return fmt.Errorf("cumulative counters can't have an increment")
+		}
+		if pm.InitialValue == "" {
+			pm.InitialValue = InitialValueZero
+		} else if pm.InitialValue != InitialValueZero && pm.InitialValue != InitialValueFirst {
+			return fmt.Errorf("initialValue must be one of %s or %s, got %s", InitialValueZero, InitialValueFirst, pm.InitialValue)
+		}
+	} else if pm.InitialValue != "" {
+		return fmt.Errorf("initialValue is only supported for cumulative counters")
+	}
+
+	// aggregates
+	if len(pm.AggregateWithout) > 0 {
+		if pm.Type != "counter" {
+			return fmt.Errorf("aggregateWithout is only supported for counters, got %s", pm.Type)
+		}
+		for _, label := range pm.AggregateWithout {
+			if _, ok := pm.Labels[label]; !ok {
+				return fmt.Errorf("aggregateWithout label %s is not a label of the metric", label)
+			}
+		}
+	}
+
+	// histogram buckets
+	if pm.Type == "histogram" {
+		if len(pm.Buckets) == 0 {
+			return fmt.Errorf("histograms require buckets")
+		}
+		for i := 1; i < len(pm.Buckets); i++ {
+			if pm.Buckets[i] <= pm.Buckets[i-1] {
+				return fmt.Errorf("histogram buckets must be sorted in increasing order, got %v", pm.Buckets)
+			}
+		}
+	} else if len(pm.Buckets) > 0 {
+		return fmt.Errorf("buckets are only supported for histograms, got %s", pm.Type)
+	}
+
+	// summary objectives
+	if pm.Type == "summary" {
+		if len(pm.Objectives) == 0 {
+			pm.Objectives = DefaultSummaryObjectives
+		}
+		for quantile, epsilon := range pm.Objectives {
+			if quantile < 0 || quantile > 1 {
+				return fmt.Errorf("summary quantiles must be between 0 and 1, got %v", quantile)
+			}
+			if epsilon < 0 || epsilon > 1 {
+				return fmt.Errorf("allowed error of summary quantile %v must be between 0 and 1, got %v", quantile, epsilon)
+			}
+		}
+		if pm.MaxAge < 0 {
+			return fmt.Errorf("maxAge must be positive, got %v", pm.MaxAge)
+		}
+	} else if len(pm.Objectives) > 0 || pm.MaxAge != 0 {
+		return fmt.Errorf("objectives and maxAge are only supported for summaries, got %s", pm.Type)
+	}
+
+	// unit conversion, counters must keep growing
+	if pm.Scale != nil && *pm.Scale == 0 {
+		return fmt.Errorf("scale must not be 0")
+	}
+	if pm.Type == "counter" && pm.Scale != nil && *pm.Scale < 0 {
+		return fmt.Errorf("scale of counters must be positive, got %v", *pm.Scale)
+	}
+
+	// predicate template
+	if pm.When != "" {
+		tmpl, err := parseValueTemplate(pm.When)
+		if err != nil {
+			return fmt.Errorf("Invalid when predicate - %s", err)
+		}
+		pm.whenTemplate = tmpl
+	}
+
+	// transform template
+	if pm.Transform != "" {
+		tmpl, err := parseValueTemplate(pm.Transform)
+		if err != nil {
+			return fmt.Errorf("Invalid transform - %s", err)
+		}
+		pm.transformTemplate = tmpl
+	}
+
 	return nil
 }
 
+// UsesSignalFxMetricName tells if the metric name is derived from the SignalFX metric name
+func (pm *PrometheusMetric) UsesSignalFxMetricName() bool {
+	return pm.Name == "" || strings.Contains(pm.Name, "SignalFxMetricName")
+}
+
 func (pm *PrometheusMetric) GetMetricName(data NameTemplateVars) (string, error) {
 	var buffer bytes.Buffer
 	err := pm.nameTemplate.Execute(&buffer, data)
 	return buffer.String(), err
 }
 
+// DefaultHelp is the help of metrics whose template has none, as some scrapers
+// warn about metrics without help
+const DefaultHelp = "Exported from SignalFX"
+
+// GetHelp renders the help of the metric, DefaultHelp if it renders empty
+func (pm *PrometheusMetric) GetHelp(data NameTemplateVars) (string, error) {
+	if pm.helpTemplate == nil {
+		return DefaultHelp, nil
+	}
+	var buffer bytes.Buffer
+	if err := pm.helpTemplate.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	if help := strings.TrimSpace(buffer.String()); help != "" {
+		return help, nil
+	}
+	return DefaultHelp, nil
+}
+
 func (pm *PrometheusMetric) GetLabelValue(labelName string, data NameTemplateVars) (string, error) {
 	tmpl, ok := pm.labelTemplates[labelName]
 	if !ok {
@@ -75,33 +283,391 @@ func (pm *PrometheusMetric) GetLabelValue(labelName string, data NameTemplateVar
 	return buffer.String(), err
 }
 
+// Shard selects the slice of series a replica processes. Series are assigned
+// by a hash of their TSID or, if Key is set, of the value of that dimension.
+type Shard struct {
+	Index uint32 `yaml:"index"`
+	Total uint32 `yaml:"total"`
+	Key   string `yaml:"key"`
+}
+
+func (s *Shard) Validate() error {
+	if s.Total == 0 {
+		return fmt.Errorf("Shard total must be positive")
+	}
+	if s.Index >= s.Total {
+		return fmt.Errorf("Shard index must be lower than the shard total %v, got %v", s.Total, s.Index)
+	}
+	return nil
+}
+
+// Owns returns whether the series with the given hash key belongs to this shard
+func (s *Shard) Owns(key string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()%s.Total == s.Index
+}
+
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (rl *RateLimit) Validate() error {
+	if rl.Rate <= 0 {
+		return fmt.Errorf("Rate limit must be positive, got %v", rl.Rate)
+	}
+	if rl.Burst == 0 {
+		rl.Burst = int(math.Ceil(rl.Rate))
+	} else if rl.Burst < 0 {
+		return fmt.Errorf("Rate limit burst must be positive, got %v", rl.Burst)
+	}
+	return nil
+}
+
 type FlowProgram struct {
-	Name              string             `yaml:"name"`
-	Query             string             `yaml:"query"`
-	HistoricalData    time.Duration      `yaml:"historicalData"`
-	MetricTemplates   []PrometheusMetric `yaml:"prometheusMetricTemplates"`
-	templatesByStream map[string]PrometheusMetric
+	Name                   string             `yaml:"name"`
+	Query                  string             `yaml:"query"`
+	HistoricalData         time.Duration      `yaml:"historicalData"`
+	Start                  time.Time          `yaml:"start"`
+	Stop                   time.Time          `yaml:"stop"`
+	Resolution             time.Duration      `yaml:"resolution"`
+	Immediate              bool               `yaml:"immediate"`
+	StalenessThreshold     time.Duration      `yaml:"stalenessThreshold"`
+	StaleAfter             time.Duration      `yaml:"staleAfter"`
+	MetricTemplates        []PrometheusMetric `yaml:"prometheusMetricTemplates"`
+	EventTemplates         []PrometheusMetric `yaml:"prometheusEventTemplates"`
+	FlowLabel              *bool              `yaml:"flowLabel"`
+	RegistrationRateLimit  *RateLimit         `yaml:"registrationRateLimit"`
+	IngestionRateLimit     *RateLimit         `yaml:"ingestionRateLimit"`
+	RealmLabel             string             `yaml:"realmLabel"`
+	TSIDLabel              string             `yaml:"tsidLabel"`
+	UserAgent              string             `yaml:"userAgent"`
+	DropEmptyLabels        bool               `yaml:"dropEmptyLabels"`
+	MetadataDebounce       time.Duration      `yaml:"metadataDebounce"`
+	CountSamples           bool               `yaml:"countSamples"`
+	DebugSampleRate        float64            `yaml:"debugSampleRate"`
+	MaxConsecutiveFailures int                `yaml:"maxConsecutiveFailures"`
+	MaxReconnects          int                `yaml:"maxReconnects"`
+	ReconnectBackoff       time.Duration      `yaml:"reconnectBackoff"`
+	MaxReconnectBackoff    time.Duration      `yaml:"maxReconnectBackoff"`
+	StableStreamDuration   time.Duration      `yaml:"stableStreamDuration"`
+	Shard                  *Shard             `yaml:"shard"`
+	CounterTotalSuffix     *bool              `yaml:"counterTotalSuffix"`
+	DefaultMetricName      string             `yaml:"defaultMetricName"`
+	ReservedLabels         string             `yaml:"reservedLabels"`
+	LabelErrors            string             `yaml:"labelErrors"`
+	LabelFallback          string             `yaml:"labelFallback"`
+	StaticLabels           map[string]string  `yaml:"staticLabels"`
+	Credential             string             `yaml:"credential"`
+	realm                  string
+	token                  string
+	queryWarnings          []string
+	templatesByStream      map[string]PrometheusMetric
+	eventTemplatesByStream map[string]PrometheusMetric
 }
 
+// ErrNoTemplate is returned for streams no template of the flow is mapped to
+var ErrNoTemplate = errors.New("No template found")
+
 func (fp *FlowProgram) GetMetricTemplateForStream(stream string) (PrometheusMetric, error) {
 	mt, ok := fp.templatesByStream[stream]
 	if !ok {
-		return PrometheusMetric{}, fmt.Errorf("No metric template found for stream %s", stream)
+		return PrometheusMetric{}, fmt.Errorf("%w - no metric template for stream %s", ErrNoTemplate, stream)
 	}
 	return mt, nil
 }
 
+func (fp *FlowProgram) GetEventTemplateForStream(stream string) (PrometheusMetric, error) {
+	et, ok := fp.eventTemplatesByStream[stream]
+	if !ok {
+		return PrometheusMetric{}, fmt.Errorf("%w - no event template for stream %s", ErrNoTemplate, stream)
+	}
+	return et, nil
+}
+
+// UnmappedStreams returns the streams published by the query of the flow
+// that neither a metric nor an event template is mapped to
+func (fp *FlowProgram) UnmappedStreams() []string {
+	unmapped := []string{}
+	for _, stream := range PublishedStreams(fp.Query) {
+		_, metric := fp.templatesByStream[stream]
+		_, event := fp.eventTemplatesByStream[stream]
+		if !metric && !event {
+			unmapped = append(unmapped, stream)
+		}
+	}
+	return unmapped
+}
+
+// StartTime is the time the SignalFlow program of the flow starts at when it
+// is executed now, zero for the current time
+func (fp *FlowProgram) StartTime(now time.Time) time.Time {
+	if !fp.Start.IsZero() {
+		return fp.Start
+	}
+	if fp.HistoricalData != 0 {
+		return now.Add(-fp.HistoricalData)
+	}
+	return time.Time{}
+}
+
+// FlowLabelName is the label reserved for the flow name when flowLabel is enabled
+const FlowLabelName = "flow"
+
+// HasFlowLabel tells if metrics of this flow carry the flow name as a label
+func (fp *FlowProgram) HasFlowLabel() bool {
+	return fp.FlowLabel != nil && *fp.FlowLabel
+}
+
+// HasCounterTotalSuffix tells if counter names of this flow get a _total suffix
+func (fp *FlowProgram) HasCounterTotalSuffix() bool {
+	return fp.CounterTotalSuffix != nil && *fp.CounterTotalSuffix
+}
+
+// QueryWarnings returns the findings for suspicious parts of the query
+func (fp *FlowProgram) QueryWarnings() []string {
+	return fp.queryWarnings
+}
+
+// Hash is a digest of the settings of the flow, including its realm and token,
+// which tells whether a flow changed between two configs
+func (fp *FlowProgram) Hash() (string, error) {
+	normalized, err := yaml.Marshal(fp)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append(normalized, []byte(fp.realm+"\x00"+fp.token)...))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Realm returns the SignalFX realm the flow is executed against
+func (fp *FlowProgram) Realm() string {
+	return fp.realm
+}
+
+// Token returns the SignalFX token the flow is executed with
+func (fp *FlowProgram) Token() string {
+	return fp.token
+}
+
+const (
+	// how labels named like the target labels of Prometheus are handled
+	ReservedLabelsKeep   = "keep"
+	ReservedLabelsError  = "error"
+	ReservedLabelsPrefix = "prefix"
+
+	// ReservedLabelPrefix is prepended to reserved labels in ReservedLabelsPrefix mode
+	ReservedLabelPrefix = "sfx_"
+)
+
+const (
+	// how labels whose template fails to render are handled
+	LabelErrorsStrict   = "strict"
+	LabelErrorsFallback = "fallback"
+	LabelErrorsDrop     = "drop"
+)
+
+// labels Prometheus attaches to scraped series, which clash with exposed ones
+var targetLabels = map[string]bool{"job": true, "instance": true}
+
+// ReservedLabelName returns the name a label is exposed with, which differs
+// for target labels like job in ReservedLabelsPrefix mode
+func (fp *FlowProgram) ReservedLabelName(name string) string {
+	if fp.ReservedLabels == ReservedLabelsPrefix && targetLabels[name] {
+		return ReservedLabelPrefix + name
+	}
+	return name
+}
+
+// handleReservedLabelNames rejects label names that can't be registered and
+// applies the reservedLabels mode to target labels like job and instance.
+//
+// labels starting with __ are reserved for Prometheus itself, and histograms
+// and summaries reserve le and quantile for their buckets and quantiles. in
+// ReservedLabelsPrefix mode target labels are renamed, including their
+// references in aggregateWithout.
+func (fp *FlowProgram) handleReservedLabelNames(pm *PrometheusMetric) error {
+	renames := map[string]string{}
+	for name := range pm.Labels {
+		if strings.HasPrefix(name, "__") || !model.LabelName(name).IsValid() {
+			return fmt.Errorf("Label %s in flow %s is not a valid label name", name, fp.Name)
+		}
+		if (pm.Type == "histogram" && name == "le") || (pm.Type == "summary" && name == "quantile") {
+			return fmt.Errorf("Label %s in flow %s is reserved for %ss", name, fp.Name, pm.Type)
+		}
+		if !targetLabels[name] {
+			continue
+		}
+		switch fp.ReservedLabels {
+		case ReservedLabelsError:
+			return fmt.Errorf("Label %s in flow %s clashes with the Prometheus target label", name, fp.Name)
+		case ReservedLabelsPrefix:
+			renames[name] = fp.ReservedLabelName(name)
+		}
+	}
+	for name, renamed := range renames {
+		if _, ok := pm.Labels[renamed]; ok {
+			return fmt.Errorf("Label %s in flow %s clashes with the prefixed label %s", renamed, fp.Name, name)
+		}
+		pm.Labels[renamed] = pm.Labels[name]
+		delete(pm.Labels, name)
+		for i, label := range pm.AggregateWithout {
+			if label == name {
+				pm.AggregateWithout[i] = renamed
+			}
+		}
+	}
+	return nil
+}
+
+func (fp *FlowProgram) validateReservedLabels(pm *PrometheusMetric) error {
+	if _, ok := pm.Labels[FlowLabelName]; ok && fp.HasFlowLabel() {
+		return fmt.Errorf("Label %s is reserved in flow %s because flowLabel is enabled", FlowLabelName, fp.Name)
+	}
+	if _, ok := pm.Labels[fp.RealmLabel]; ok && fp.RealmLabel != "" {
+		return fmt.Errorf("Label %s is reserved in flow %s because it is the realmLabel", fp.RealmLabel, fp.Name)
+	}
+	if _, ok := pm.Labels[fp.TSIDLabel]; ok && fp.TSIDLabel != "" {
+		return fmt.Errorf("Label %s is reserved in flow %s because it is the tsidLabel", fp.TSIDLabel, fp.Name)
+	}
+	for name := range fp.StaticLabels {
+		if _, ok := pm.Labels[name]; ok {
+			return fmt.Errorf("Label %s in flow %s clashes with the static label of the same name", name, fp.Name)
+		}
+		if (pm.Type == "histogram" && name == "le") || (pm.Type == "summary" && name == "quantile") {
+			return fmt.Errorf("Static label %s in flow %s is reserved for %ss", name, fp.Name, pm.Type)
+		}
+	}
+	return nil
+}
+
+// validateStaticLabels checks the static labels of the flow against the
+// labels the flow adds itself, clashes with templates are checked per template
+func (fp *FlowProgram) validateStaticLabels() error {
+	for name := range fp.StaticLabels {
+		if strings.HasPrefix(name, "__") || !model.LabelName(name).IsValid() {
+			return fmt.Errorf("Static label %s in flow %s is not a valid label name", name, fp.Name)
+		}
+		if targetLabels[name] && fp.ReservedLabels != ReservedLabelsKeep {
+			return fmt.Errorf("Static label %s in flow %s clashes with the Prometheus target label", name, fp.Name)
+		}
+		if (name == FlowLabelName && fp.HasFlowLabel()) || name == fp.RealmLabel || name == fp.TSIDLabel {
+			return fmt.Errorf("Static label %s in flow %s is reserved for the flow, realm or tsid label", name, fp.Name)
+		}
+	}
+	return nil
+}
+
 func (fp *FlowProgram) Validate() error {
+	if fp.Resolution < 0 {
+		return fmt.Errorf("resolution in flow %s must be positive, got %v", fp.Name, fp.Resolution)
+	}
+	if !fp.Start.IsZero() && fp.HistoricalData != 0 {
+		return fmt.Errorf("Flow %s can't set both start and historicalData", fp.Name)
+	}
+	if !fp.Start.IsZero() && !fp.Stop.IsZero() && !fp.Start.Before(fp.Stop) {
+		return fmt.Errorf("start in flow %s must be before stop, got %v and %v", fp.Name, fp.Start, fp.Stop)
+	}
+	if fp.StalenessThreshold < 0 {
+		return fmt.Errorf("stalenessThreshold in flow %s must be positive, got %v", fp.Name, fp.StalenessThreshold)
+	}
+	if fp.StaleAfter < 0 {
+		return fmt.Errorf("staleAfter in flow %s must be positive, got %v", fp.Name, fp.StaleAfter)
+	}
+	if fp.MetadataDebounce < 0 {
+		return fmt.Errorf("metadataDebounce in flow %s must be positive, got %v", fp.Name, fp.MetadataDebounce)
+	}
+	if fp.DebugSampleRate < 0 || fp.DebugSampleRate > 1 {
+		return fmt.Errorf("debugSampleRate in flow %s must be between 0 and 1, got %v", fp.Name, fp.DebugSampleRate)
+	}
+	if fp.MaxConsecutiveFailures < 0 {
+		return fmt.Errorf("maxConsecutiveFailures in flow %s must be positive, got %v", fp.Name, fp.MaxConsecutiveFailures)
+	}
+	if fp.MaxReconnects < 0 {
+		return fmt.Errorf("maxReconnects in flow %s must be positive, got %v", fp.Name, fp.MaxReconnects)
+	}
+	if fp.ReconnectBackoff == 0 {
+		fp.ReconnectBackoff = DefaultReconnectBackoff
+	}
+	if fp.MaxReconnectBackoff == 0 {
+		fp.MaxReconnectBackoff = DefaultMaxReconnectBackoff
+	}
+	if fp.ReconnectBackoff < 0 || fp.MaxReconnectBackoff < fp.ReconnectBackoff {
+		return fmt.Errorf("reconnectBackoff in flow %s must be positive and at most maxReconnectBackoff, got %v and %v", fp.Name, fp.ReconnectBackoff, fp.MaxReconnectBackoff)
+	}
+	if fp.StableStreamDuration == 0 {
+		fp.StableStreamDuration = DefaultStableStreamDuration
+	} else if fp.StableStreamDuration < 0 {
+		return fmt.Errorf("stableStreamDuration in flow %s must be positive, got %v", fp.Name, fp.StableStreamDuration)
+	}
+	if fp.ReservedLabels == "" {
+		fp.ReservedLabels = ReservedLabelsKeep
+	} else if fp.ReservedLabels != ReservedLabelsKeep && fp.ReservedLabels != ReservedLabelsError && fp.ReservedLabels != ReservedLabelsPrefix {
+		return fmt.Errorf("reservedLabels in flow %s must be one of %s, %s or %s, got %s", fp.Name, ReservedLabelsKeep, ReservedLabelsError, ReservedLabelsPrefix, fp.ReservedLabels)
+	}
+	if fp.LabelErrors == "" {
+		fp.LabelErrors = LabelErrorsStrict
+	} else if fp.LabelErrors != LabelErrorsStrict && fp.LabelErrors != LabelErrorsFallback && fp.LabelErrors != LabelErrorsDrop {
+		return fmt.Errorf("labelErrors in flow %s must be one of %s, %s or %s, got %s", fp.Name, LabelErrorsStrict, LabelErrorsFallback, LabelErrorsDrop, fp.LabelErrors)
+	}
+	if fp.LabelErrors == LabelErrorsFallback && fp.LabelFallback == "" {
+		return fmt.Errorf("labelFallback in flow %s must be set with labelErrors %s", fp.Name, LabelErrorsFallback)
+	}
+
+	warnings, err := LintQuery(fp.Query)
+	if err != nil {
+		return fmt.Errorf("SignalFlow program for %s is invalid - %s", fp.Name, err)
+	}
+	fp.queryWarnings = warnings
+
+	if fp.RealmLabel != "" && fp.RealmLabel == FlowLabelName && fp.HasFlowLabel() {
+		return fmt.Errorf("realmLabel %s in flow %s conflicts with the flow label", fp.RealmLabel, fp.Name)
+	}
+	if fp.TSIDLabel != "" && ((fp.TSIDLabel == FlowLabelName && fp.HasFlowLabel()) || fp.TSIDLabel == fp.RealmLabel) {
+		return fmt.Errorf("tsidLabel %s in flow %s conflicts with the flow or realm label", fp.TSIDLabel, fp.Name)
+	}
+	if err := fp.validateStaticLabels(); err != nil {
+		return err
+	}
+	if fp.RegistrationRateLimit != nil {
+		if err := fp.RegistrationRateLimit.Validate(); err != nil {
+			return fmt.Errorf("Invalid registrationRateLimit in flow %s - %s", fp.Name, err)
+		}
+	}
+	if fp.IngestionRateLimit != nil {
+		if err := fp.IngestionRateLimit.Validate(); err != nil {
+			return fmt.Errorf("Invalid ingestionRateLimit in flow %s - %s", fp.Name, err)
+		}
+	}
+	if fp.Shard != nil {
+		if err := fp.Shard.Validate(); err != nil {
+			return fmt.Errorf("Invalid shard in flow %s - %s", fp.Name, err)
+		}
+	}
+
 	defaultStreamFound := false
 	fp.templatesByStream = make(map[string]PrometheusMetric)
 	for i := range fp.MetricTemplates {
 		mtp := &fp.MetricTemplates[i]
+		if _, ok := metricTypes[mtp.Type]; !ok {
+			return fmt.Errorf("Metric template in flow %s has unsupported type %q, must be one of counter, gauge, histogram or summary", fp.Name, mtp.Type)
+		}
+		if mtp.StaleAfter == 0 {
+			mtp.StaleAfter = fp.StaleAfter
+		}
+		if err := fp.handleReservedLabelNames(mtp); err != nil {
+			return err
+		}
 		if err := mtp.Validate(); err != nil {
 			return err
 		}
 		if mtp.Stream == "" {
 			mtp.Stream = "default"
 		}
+		if err := fp.validateReservedLabels(mtp); err != nil {
+			return err
+		}
 		if mtp.Stream == "default" && defaultStreamFound {
 			return fmt.Errorf("More than one default stream found in flow %s", fp.Name)
 		} else if mtp.Stream == "default" {
@@ -109,40 +675,402 @@ func (fp *FlowProgram) Validate() error {
 		}
 		fp.templatesByStream[mtp.Stream] = *mtp
 	}
+
+	// events are always counted
+	fp.eventTemplatesByStream = make(map[string]PrometheusMetric)
+	for i := range fp.EventTemplates {
+		etp := &fp.EventTemplates[i]
+		if err := fp.handleReservedLabelNames(etp); err != nil {
+			return err
+		}
+		if etp.Type == "" {
+			etp.Type = "counter"
+		} else if etp.Type != "counter" {
+			return fmt.Errorf("Event template in flow %s must be of type counter, got %s", fp.Name, etp.Type)
+		}
+		if unsupported := etp.eventUnsupported(); len(unsupported) > 0 {
+			return fmt.Errorf("Event template in flow %s doesn't support %s, events are counted one by one", fp.Name, strings.Join(unsupported, ", "))
+		}
+		if err := etp.Validate(); err != nil {
+			return err
+		}
+		if etp.Stream == "" {
+			etp.Stream = "default"
+		}
+		if err := fp.validateReservedLabels(etp); err != nil {
+			return err
+		}
+		if _, ok := fp.eventTemplatesByStream[etp.Stream]; ok {
+			return fmt.Errorf("More than one event template for stream %s found in flow %s", etp.Stream, fp.Name)
+		}
+		fp.eventTemplatesByStream[etp.Stream] = *etp
+	}
 	return nil
 }
 
+// DefaultUserAgent identifies the exporter and its version towards SignalFX
+var DefaultUserAgent = "signalfx-prometheus-exporter/" + version.Version
+
 type Sfx struct {
-	Realm string `yaml:"realm"`
-	Token string `yaml:"token"`
+	Realm                 string `yaml:"realm"`
+	Token                 string `yaml:"token"`
+	TokenEnv              string `yaml:"tokenEnv"`
+	TokenFile             string `yaml:"tokenFile"`
+	UserAgent             string `yaml:"userAgent"`
+	MaxConcurrentPrograms int    `yaml:"maxConcurrentPrograms"`
 }
 
 func (sfx *Sfx) Validate() error {
+	if sfx.MaxConcurrentPrograms < 0 {
+		return fmt.Errorf("maxConcurrentPrograms must be positive, got %v", sfx.MaxConcurrentPrograms)
+	}
 	if sfx.Realm == "" {
 		sfx.Realm = "us1"
 	}
+	if sfx.UserAgent == "" {
+		sfx.UserAgent = DefaultUserAgent
+	}
+	token, err := resolveToken(sfx.Token, sfx.TokenEnv, sfx.TokenFile)
+	if err != nil {
+		return err
+	}
+	sfx.Token = token
+	return nil
+}
+
+// resolveToken returns the token given literally, from the environment
+// variable tokenEnv or from the file tokenFile.
+//
+// only one of them may be set. without any of them, the token is empty.
+func resolveToken(token string, tokenEnv string, tokenFile string) (string, error) {
+	sources := 0
+	for _, source := range []string{token, tokenEnv, tokenFile} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", fmt.Errorf("Only one of token, tokenEnv or tokenFile may be set")
+	}
+	if tokenEnv != "" {
+		token = strings.TrimSpace(os.Getenv(tokenEnv))
+		if token == "" {
+			return "", fmt.Errorf("Environment variable %s of the SignalFX token is empty", tokenEnv)
+		}
+	}
+	if tokenFile != "" {
+		content, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read SignalFX token file - %s", err)
+		}
+		token = strings.TrimSpace(string(content))
+		if token == "" {
+			return "", fmt.Errorf("SignalFX token file %s is empty", tokenFile)
+		}
+	}
+	return token, nil
+}
+
+// Credential is a named SignalFX realm and token, which flows can use instead
+// of the ones of sfx
+type Credential struct {
+	Realm                 string `yaml:"realm"`
+	Token                 string `yaml:"token"`
+	TokenEnv              string `yaml:"tokenEnv"`
+	TokenFile             string `yaml:"tokenFile"`
+	MaxConcurrentPrograms int    `yaml:"maxConcurrentPrograms"`
+}
+
+// Credentials are the named credentials of a config
+type Credentials map[string]*Credential
+
+func (cr *Credential) Validate(name string, defaultRealm string) error {
+	if cr.Realm == "" {
+		cr.Realm = defaultRealm
+	}
+	if cr.MaxConcurrentPrograms < 0 {
+		return fmt.Errorf("Credential %s has a negative maxConcurrentPrograms %v", name, cr.MaxConcurrentPrograms)
+	}
+	token, err := resolveToken(cr.Token, cr.TokenEnv, cr.TokenFile)
+	if err != nil {
+		return fmt.Errorf("Invalid credential %s - %s", name, err)
+	}
+	if token == "" {
+		return fmt.Errorf("Credential %s has no token, set one of token, tokenEnv or tokenFile", name)
+	}
+	cr.Token = token
+	return nil
+}
+
+// eventUnsupported lists the settings of a template that event templates ignore
+func (pm *PrometheusMetric) eventUnsupported() []string {
+	unsupported := []string{}
+	if pm.Increment != "" {
+		unsupported = append(unsupported, "increment")
+	}
+	if pm.Transform != "" {
+		unsupported = append(unsupported, "transform")
+	}
+	if pm.Scale != nil || pm.Offset != 0 {
+		unsupported = append(unsupported, "scale")
+	}
+	if pm.Cumulative {
+		unsupported = append(unsupported, "cumulative")
+	}
+	if len(pm.AggregateWithout) > 0 {
+		unsupported = append(unsupported, "aggregateWithout")
+	}
+	if pm.When != "" {
+		unsupported = append(unsupported, "when")
+	}
+	return unsupported
+}
+
+// RealmLimits returns the maxConcurrentPrograms of every realm of sfx and the
+// credentials. credentials without a limit use the one of sfx, flows of the
+// same realm share the lowest limit and realms without a limit are left out.
+func (c *Config) RealmLimits() map[string]int {
+	limits := make(map[string]int)
+	limit := func(realm string, programs int) {
+		if programs <= 0 {
+			return
+		}
+		if current, ok := limits[realm]; !ok || programs < current {
+			limits[realm] = programs
+		}
+	}
+	limit(c.Sfx.Realm, c.Sfx.MaxConcurrentPrograms)
+	for _, credential := range c.Credentials {
+		if credential.MaxConcurrentPrograms > 0 {
+			limit(credential.Realm, credential.MaxConcurrentPrograms)
+		} else {
+			limit(credential.Realm, c.Sfx.MaxConcurrentPrograms)
+		}
+	}
+	return limits
+}
+
+type CloudWatch struct {
+	Namespace string        `yaml:"namespace"`
+	Region    string        `yaml:"region"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+func (cw *CloudWatch) Validate() error {
+	if cw.Namespace == "" {
+		return fmt.Errorf("CloudWatch namespace is required")
+	}
+	if cw.Interval == 0 {
+		cw.Interval = time.Minute
+	} else if cw.Interval < 0 {
+		return fmt.Errorf("CloudWatch interval must be positive, got %v", cw.Interval)
+	}
+	return nil
+}
+
+type Graphite struct {
+	Address     string        `yaml:"address"`
+	Prefix      string        `yaml:"prefix"`
+	Interval    time.Duration `yaml:"interval"`
+	LabelScheme string        `yaml:"labelScheme"`
+}
+
+func (g *Graphite) Validate() error {
+	if g.Address == "" {
+		return fmt.Errorf("Graphite address is required")
+	}
+	if g.Interval == 0 {
+		g.Interval = time.Minute
+	} else if g.Interval < 0 {
+		return fmt.Errorf("Graphite interval must be positive, got %v", g.Interval)
+	}
+	if g.LabelScheme == "" {
+		g.LabelScheme = "pairs"
+	} else if g.LabelScheme != "pairs" && g.LabelScheme != "values" {
+		return fmt.Errorf("Graphite labelScheme must be one of pairs or values, got %s", g.LabelScheme)
+	}
+	return nil
+}
+
+// TLS serves the scrape and observability endpoints over https
+type TLS struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// Enabled tells whether a certificate is configured
+func (t *TLS) Enabled() bool {
+	return t != nil && t.CertFile != ""
+}
+
+func (t *TLS) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("TLS requires both a certificate and a key, got certificate %q and key %q", t.CertFile, t.KeyFile)
+	}
+	if t.ClientCAFile != "" && t.CertFile == "" {
+		return fmt.Errorf("TLS client CA requires a certificate and a key")
+	}
+	return nil
+}
+
+type Kafka struct {
+	Brokers       []string      `yaml:"brokers"`
+	Topic         string        `yaml:"topic"`
+	Serialization string        `yaml:"serialization"`
+	BatchSize     int           `yaml:"batchSize"`
+	BatchTimeout  time.Duration `yaml:"batchTimeout"`
+}
+
+func (k *Kafka) Validate() error {
+	if len(k.Brokers) == 0 {
+		return fmt.Errorf("At least one kafka broker is required")
+	}
+	if k.Topic == "" {
+		return fmt.Errorf("Kafka topic is required")
+	}
+	if k.Serialization == "" {
+		k.Serialization = "json"
+	} else if k.Serialization != "json" && k.Serialization != "protobuf" {
+		return fmt.Errorf("Kafka serialization must be one of json or protobuf, got %s", k.Serialization)
+	}
+	if k.BatchSize < 0 {
+		return fmt.Errorf("Kafka batchSize must be positive, got %d", k.BatchSize)
+	}
+	if k.BatchTimeout < 0 {
+		return fmt.Errorf("Kafka batchTimeout must be positive, got %v", k.BatchTimeout)
+	}
 	return nil
 }
 
 type Config struct {
-	Sfx       Sfx           `yaml:"sfx"`
-	Flows     []FlowProgram `yaml:"flows"`
-	Groupings []Grouping    `yaml:"grouping"`
+	Sfx                Sfx             `yaml:"sfx"`
+	Flows              []FlowProgram   `yaml:"flows"`
+	Groupings          []Grouping      `yaml:"grouping"`
+	FlowLabel          bool            `yaml:"flowLabel"`
+	Graphite           *Graphite       `yaml:"graphite"`
+	Kafka              *Kafka          `yaml:"kafka"`
+	Shard              *Shard          `yaml:"shard"`
+	LabelOrder         []string        `yaml:"labelOrder"`
+	CounterTotalSuffix bool            `yaml:"counterTotalSuffix"`
+	ReservedLabels     string          `yaml:"reservedLabels"`
+	CloudWatch         *CloudWatch     `yaml:"cloudwatch"`
+	IngestionRateLimit *RateLimit      `yaml:"ingestionRateLimit"`
+	NameMappingFile    string          `yaml:"nameMappingFile"`
+	FlowInfo           bool            `yaml:"flowInfo"`
+	SelfMetrics        bool            `yaml:"selfMetrics"`
+	DerivedMetrics     []DerivedMetric `yaml:"derivedMetrics"`
+	Credentials        Credentials     `yaml:"credentials"`
+	TLS                *TLS            `yaml:"tls"`
 }
 
-func (c *Config) Validate() error {
+// validateSettings validates everything but the flows
+func (c *Config) validateSettings() error {
 	if err := c.Sfx.Validate(); err != nil {
 		return err
 	}
+	if c.Sfx.Token == "" && len(c.Credentials) == 0 {
+		return fmt.Errorf("No SignalFX token, set one of token, tokenEnv or tokenFile")
+	}
+	for name, credential := range c.Credentials {
+		if credential == nil {
+			return fmt.Errorf("Credential %s is empty", name)
+		}
+		if err := credential.Validate(name, c.Sfx.Realm); err != nil {
+			return err
+		}
+	}
+	if c.Graphite != nil {
+		if err := c.Graphite.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Kafka != nil {
+		if err := c.Kafka.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.CloudWatch != nil {
+		if err := c.CloudWatch.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.IngestionRateLimit != nil {
+		if err := c.IngestionRateLimit.Validate(); err != nil {
+			return fmt.Errorf("Invalid ingestionRateLimit - %s", err)
+		}
+	}
+	for i := range c.DerivedMetrics {
+		if err := c.DerivedMetrics[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if err := c.validateSettings(); err != nil {
+		return err
+	}
+	// flows are told apart by name, in their self observability metrics as well
+	flowNames := make(map[string]int, len(c.Flows))
 	for i := range c.Flows {
-		fp := &c.Flows[i]
-		if err := fp.Validate(); err != nil {
+		if err := c.validateFlow(i, flowNames); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// validateFlow applies the top-level defaults to the i-th flow and validates
+// it, flowNames tracks the names of the flows validated so far
+func (c *Config) validateFlow(i int, flowNames map[string]int) error {
+	fp := &c.Flows[i]
+	if fp.Name == "" {
+		return fmt.Errorf("Flow %d has no name", i+1)
+	}
+	if strings.TrimSpace(fp.Query) == "" {
+		return fmt.Errorf("Flow %s has no query", fp.Name)
+	}
+	if first, ok := flowNames[fp.Name]; ok {
+		return fmt.Errorf("Duplicate flow name %s, used by flows %d and %d", fp.Name, first+1, i+1)
+	}
+	flowNames[fp.Name] = i
+	if fp.FlowLabel == nil {
+		fp.FlowLabel = &c.FlowLabel
+	}
+	if fp.CounterTotalSuffix == nil {
+		fp.CounterTotalSuffix = &c.CounterTotalSuffix
+	}
+	if fp.ReservedLabels == "" {
+		fp.ReservedLabels = c.ReservedLabels
+	}
+	fp.realm = c.Sfx.Realm
+	fp.token = c.Sfx.Token
+	if fp.Credential != "" {
+		credential, ok := c.Credentials[fp.Credential]
+		if !ok {
+			return fmt.Errorf("Flow %s references the unknown credential %s", fp.Name, fp.Credential)
+		}
+		fp.realm = credential.Realm
+		fp.token = credential.Token
+	} else if fp.token == "" {
+		return fmt.Errorf("Flow %s has no SignalFX token, set sfx.token or a credential of the flow", fp.Name)
+	}
+	if fp.UserAgent == "" {
+		fp.UserAgent = c.Sfx.UserAgent
+	}
+	if fp.Shard == nil {
+		fp.Shard = c.Shard
+	}
+	return fp.Validate()
+}
+
 func LoadConfigFromBytes(configBytes []byte) (*Config, error) {
 	var cfg Config
 	err := yaml.Unmarshal(configBytes, &cfg)
@@ -150,7 +1078,9 @@ func LoadConfigFromBytes(configBytes []byte) (*Config, error) {
 		return nil, err
 	}
 
-	cfg.Validate()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
@@ -161,3 +1091,53 @@ func LoadConfig(file string) (*Config, error) {
 	}
 	return LoadConfigFromBytes(configBytes)
 }
+
+// FlowCheck is the result of validating a single flow of a config
+type FlowCheck struct {
+	Name string
+	Err  error
+}
+
+// CheckConfig validates a config file like LoadConfig, but carries on after
+// an invalid flow to report on every flow.
+//
+// an error is returned for a config that can't be read or has invalid settings
+// outside of its flows. on top of LoadConfig, flows fail for streams they publish
+// without a template.
+func CheckConfig(file string) ([]FlowCheck, error) {
+	configBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(configBytes, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateSettings(); err != nil {
+		return nil, err
+	}
+	checks := make([]FlowCheck, len(cfg.Flows))
+	flowNames := make(map[string]int, len(cfg.Flows))
+	for i := range cfg.Flows {
+		fp := &cfg.Flows[i]
+		err := cfg.validateFlow(i, flowNames)
+		if err == nil {
+			if streams := fp.UnmappedStreams(); len(streams) > 0 {
+				err = fmt.Errorf("Flow %s publishes streams without a template: %s", fp.Name, strings.Join(streams, ", "))
+			}
+		}
+		checks[i] = FlowCheck{Name: fp.Name, Err: err}
+	}
+	return checks, nil
+}
+
+// Hash is a digest of the normalized config, i.e. after defaults were applied,
+// which is equal for equivalent configs regardless of formatting
+func (c *Config) Hash() (string, error) {
+	normalized, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:8]), nil
+}
@@ -1,7 +1,12 @@
 package config_test
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"signalfx-prometheus-exporter/config"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,7 +21,7 @@ func TestExampleSingleMetric(t *testing.T) {
 	assert.Equal(t, 1, len(c.Flows))
 
 	_, err = c.Flows[0].GetMetricTemplateForStream("foo")
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, config.ErrNoTemplate))
 	_, err = c.Flows[0].GetMetricTemplateForStream("default")
 	assert.Nil(t, err)
 }
@@ -50,7 +55,7 @@ func TestGetLabelValue(t *testing.T) {
 func TestMinMetricsNotAUInt(t *testing.T) {
 	configFile := `---
 sfx:
-token: xxx
+  token: xxx
 flows:
 - name: catchpoint-data
   query: |
@@ -73,7 +78,7 @@ grouping:
 func TestMinHistoricalData(t *testing.T) {
 	configFile := `---
 sfx:
-token: xxx
+  token: xxx
 flows:
 - name: catchpoint-data
   historicalData: 99s
@@ -92,3 +97,1054 @@ flows:
 	ninty_nine, _ := time.ParseDuration("99s")
 	assert.Equal(t, cfg.Flows[0].HistoricalData, ninty_nine)
 }
+
+func TestExecutionSettings(t *testing.T) {
+	load := func(settings string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: executed
+  query: data('executed').publish()
+` + settings + `
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+	}
+	cfg, err := load("  resolution: 1m\n  immediate: true\n  start: 2022-03-01T10:00:00Z\n  stop: 2022-03-01T11:00:00Z")
+	assert.Nil(t, err)
+	fp := cfg.Flows[0]
+	assert.Equal(t, time.Minute, fp.Resolution)
+	assert.True(t, fp.Immediate)
+	assert.Equal(t, time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC), fp.StartTime(time.Now()).UTC())
+
+	// historicalData starts relative to the time of execution
+	now := time.Now()
+	cfg, err = load("  historicalData: 1h")
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-time.Hour), cfg.Flows[0].StartTime(now))
+	cfg, err = load("")
+	assert.Nil(t, err)
+	assert.True(t, cfg.Flows[0].StartTime(now).IsZero())
+
+	for _, invalid := range []string{
+		"  resolution: -1s",
+		"  start: 2022-03-01T10:00:00Z\n  historicalData: 1h",
+		"  start: 2022-03-01T11:00:00Z\n  stop: 2022-03-01T10:00:00Z",
+	} {
+		_, err := load(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestEventTemplates(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: deployments
+  query: |
+    events(eventType='deployment').publish()
+  prometheusEventTemplates:
+  - name: deployments_total
+    labels:
+      service: '{{ .SignalFxLabels.service }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+
+	et, err := cfg.Flows[0].GetEventTemplateForStream("default")
+	assert.Nil(t, err)
+	assert.Equal(t, "counter", et.Type)
+
+	_, err = cfg.Flows[0].GetEventTemplateForStream("foo")
+	assert.NotNil(t, err)
+}
+
+func TestEventTemplatesMustBeCounters(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: deployments
+  query: |
+    events(eventType='deployment').publish()
+  prometheusEventTemplates:
+  - name: deployments
+    type: gauge
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+}
+
+func TestEventTemplatesRejectValueSettings(t *testing.T) {
+	load := func(settings string) error {
+		_, err := config.LoadConfigFromBytes([]byte(`---
+sfx:
+  token: xxx
+flows:
+- name: deployments
+  query: |
+    events(eventType='deployment').publish()
+  prometheusEventTemplates:
+  - name: deployments_total
+` + settings))
+		return err
+	}
+	for _, settings := range []string{
+		"    increment: '{{ .Value }}'\n",
+		"    transform: '{{ sub .Value 1 }}'\n",
+		"    scale: -1\n",
+		"    cumulative: true\n",
+		"    aggregateWithout: [service]\n",
+	} {
+		err := load(settings)
+		if assert.NotNil(t, err, settings) {
+			assert.Contains(t, err.Error(), "events are counted one by one")
+		}
+	}
+}
+
+func TestFlowLabel(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flowLabel: true
+flows:
+- name: inherited
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+- name: disabled
+  flowLabel: false
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.True(t, cfg.Flows[0].HasFlowLabel())
+	assert.False(t, cfg.Flows[1].HasFlowLabel())
+}
+
+func TestFlowLabelConflict(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: conflicting
+  flowLabel: true
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      flow: '{{ .SignalFxLabels.flow }}'
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "reserved")
+}
+
+func TestGetMetricNameFromInternalProperties(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: internal
+  query: data('foo').publish('bar')
+  prometheusMetricTemplates:
+  - type: gauge
+    name: '{{ .SignalFxMetricName }}_{{ .SignalFxInternal.sf_streamLabel }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	mt, _ := cfg.Flows[0].GetMetricTemplateForStream("default")
+
+	x, err := mt.GetMetricName(config.NameTemplateVars{
+		SignalFxMetricName: "foo",
+		SignalFxInternal:   map[string]string{"sf_streamLabel": "bar"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "foo_bar", x)
+}
+
+func TestRegistrationRateLimit(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: limited
+  query: data('foo').publish()
+  registrationRateLimit:
+    rate: 2.5
+  prometheusMetricTemplates:
+  - type: gauge
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, 2.5, cfg.Flows[0].RegistrationRateLimit.Rate)
+	assert.Equal(t, 3, cfg.Flows[0].RegistrationRateLimit.Burst)
+
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "rate: 2.5", "rate: 0", 1)))
+	assert.NotNil(t, err)
+}
+
+func TestGraphiteDefaults(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+graphite:
+  address: carbon:2003
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, cfg.Graphite.Interval)
+	assert.Equal(t, "pairs", cfg.Graphite.LabelScheme)
+
+	_, err = config.LoadConfigFromBytes([]byte(configFile + "  labelScheme: foo\n"))
+	assert.NotNil(t, err)
+}
+
+func TestRealmLabel(t *testing.T) {
+	configFile := `---
+sfx:
+  realm: eu0
+  token: xxx
+flows:
+- name: realm
+  realmLabel: realm
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, "eu0", cfg.Flows[0].Realm())
+
+	_, err = config.LoadConfigFromBytes([]byte(configFile + "    labels:\n      realm: foo\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "reserved")
+}
+
+func TestUserAgent(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: default
+  query: data('foo').publish()
+- name: custom
+  userAgent: team-a
+  query: data('foo').publish()
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, config.DefaultUserAgent, cfg.Sfx.UserAgent)
+	assert.Equal(t, config.DefaultUserAgent, cfg.Flows[0].UserAgent)
+	assert.Equal(t, "team-a", cfg.Flows[1].UserAgent)
+}
+
+func TestCounterIncrement(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: increments
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    increment: '{{ .SignalFxLabels.batch }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	mt, _ := cfg.Flows[0].GetMetricTemplateForStream("default")
+
+	increment, err := mt.GetIncrement(config.NameTemplateVars{SignalFxLabels: map[string]string{"batch": "5"}}, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, 5.0, increment)
+
+	_, err = mt.GetIncrement(config.NameTemplateVars{SignalFxLabels: map[string]string{"batch": "-5"}}, 42)
+	assert.NotNil(t, err)
+	_, err = mt.GetIncrement(config.NameTemplateVars{SignalFxLabels: map[string]string{"batch": "many"}}, 42)
+	assert.NotNil(t, err)
+
+	// constants are validated on load
+	cfg, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "'{{ .SignalFxLabels.batch }}'", "1", 1)))
+	assert.Nil(t, err)
+	mt, _ = cfg.Flows[0].GetMetricTemplateForStream("default")
+	increment, err = mt.GetIncrement(config.NameTemplateVars{}, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, increment)
+
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "'{{ .SignalFxLabels.batch }}'", "-1", 1)))
+	assert.NotNil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "type: counter", "type: gauge", 1)))
+	assert.NotNil(t, err)
+}
+
+func TestShard(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+shard:
+  index: 1
+  total: 4
+flows:
+- name: inherited
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+- name: own
+  query: data('foo').publish()
+  shard:
+    index: 0
+    total: 2
+    key: host
+  prometheusMetricTemplates:
+  - type: gauge
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), cfg.Flows[0].Shard.Index)
+	assert.Equal(t, "host", cfg.Flows[1].Shard.Key)
+
+	// every key is owned by exactly one shard
+	shards := []config.Shard{{Index: 0, Total: 3}, {Index: 1, Total: 3}, {Index: 2, Total: 3}}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		owners := 0
+		for _, s := range shards {
+			if s.Owns(key) {
+				owners++
+			}
+		}
+		assert.Equal(t, 1, owners)
+	}
+
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "index: 1", "index: 4", 1)))
+	assert.NotNil(t, err)
+}
+
+func TestTransform(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: transforms
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    transform: '{{ if eq .SignalFxLabels.unit "KiB" }}{{ mul (max .Value 0) 1024 }}{{ else }}{{ clamp 0 100 .Value }}{{ end }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	mt, _ := cfg.Flows[0].GetMetricTemplateForStream("default")
+
+	kib := config.NameTemplateVars{SignalFxLabels: map[string]string{"unit": "KiB"}}
+	value, err := mt.TransformValue(kib, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2048.0, value)
+	value, err = mt.TransformValue(kib, -2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, value)
+	value, err = mt.TransformValue(config.NameTemplateVars{}, 250)
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, value)
+
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "{{ else }}", "{{ els }}", 1)))
+	assert.NotNil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "clamp 0", "unknown 0", 1)))
+	assert.NotNil(t, err)
+}
+
+func TestHelp(t *testing.T) {
+	cfg, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: helpful
+  query: data('a').publish('a'); data('b').publish('b'); data('c').publish('c')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+    help: 'Utilization of {{ .SignalFxLabels.resource }}, from {{ .SignalFxMetricName }}'
+  - type: gauge
+    stream: b
+  - type: gauge
+    stream: c
+    help: '{{ with .SignalFxLabels.missing }}{{ . }}{{ end }}'
+`))
+	assert.Nil(t, err)
+	vars := config.NameTemplateVars{SignalFxMetricName: "cpu_utilization", SignalFxLabels: map[string]string{"resource": "cpu"}}
+	for stream, expected := range map[string]string{"a": "Utilization of cpu, from cpu_utilization", "b": config.DefaultHelp, "c": config.DefaultHelp} {
+		mt, _ := cfg.Flows[0].GetMetricTemplateForStream(stream)
+		help, err := mt.GetHelp(vars)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, help, stream)
+	}
+}
+
+func TestScale(t *testing.T) {
+	load := func(metricType string, scale string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: scaled
+  query: data('scaled').publish()
+  prometheusMetricTemplates:
+  - type: ` + metricType + `
+    ` + scale + `
+`))
+	}
+	cfg, err := load("gauge", "scale: 0.001\n    offset: 1")
+	assert.Nil(t, err)
+	mt, _ := cfg.Flows[0].GetMetricTemplateForStream("default")
+	assert.Equal(t, 3.0, mt.ScaleValue(2000))
+
+	// counters ignore the offset
+	cfg, err = load("counter", "scale: 8\n    offset: 1")
+	assert.Nil(t, err)
+	mt, _ = cfg.Flows[0].GetMetricTemplateForStream("default")
+	assert.Equal(t, 16.0, mt.ScaleIncrement(2))
+
+	// without scale, values are kept as they are
+	cfg, err = load("gauge", "")
+	assert.Nil(t, err)
+	mt, _ = cfg.Flows[0].GetMetricTemplateForStream("default")
+	assert.Equal(t, 2.0, mt.ScaleValue(2))
+
+	_, err = load("gauge", "scale: 0")
+	assert.NotNil(t, err)
+	_, err = load("counter", "scale: -1")
+	assert.NotNil(t, err)
+}
+
+func TestTransformMustRenderNumbers(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: transforms
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    transform: '{{ div .Value (float .SignalFxLabels.divisor) }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	mt, _ := cfg.Flows[0].GetMetricTemplateForStream("default")
+
+	value, err := mt.TransformValue(config.NameTemplateVars{SignalFxLabels: map[string]string{"divisor": "4"}}, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.5, value)
+	_, err = mt.TransformValue(config.NameTemplateVars{SignalFxLabels: map[string]string{"divisor": "0"}}, 10)
+	assert.NotNil(t, err)
+	_, err = mt.TransformValue(config.NameTemplateVars{SignalFxLabels: map[string]string{"divisor": "none"}}, 10)
+	assert.NotNil(t, err)
+}
+
+func TestCumulativeCounters(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: cumulative
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    cumulative: true
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, config.InitialValueZero, cfg.Flows[0].MetricTemplates[0].InitialValue)
+
+	_, err = config.LoadConfigFromBytes([]byte(configFile + "    initialValue: first\n"))
+	assert.Nil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(configFile + "    initialValue: last\n"))
+	assert.NotNil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "type: counter", "type: gauge", 1)))
+	assert.NotNil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "cumulative: true", "initialValue: first", 1)))
+	assert.NotNil(t, err)
+}
+
+func TestAggregateWithoutUnknownLabel(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: aggregated
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    aggregateWithout: [host]
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "[host]", "[zone]", 1)))
+	assert.NotNil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "type: counter", "type: gauge", 1)))
+	assert.NotNil(t, err)
+}
+
+func TestTSIDLabelIsReserved(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: traced
+  query: data('foo').publish()
+  tsidLabel: tsid
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "host:", "tsid:", 1)))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "reserved")
+}
+
+func TestWhenPredicate(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: filtered
+  query: data('foo').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    when: '{{ and (eq .SignalFxLabels.env "prod") (gt .Value 0.0) }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	mt, _ := cfg.Flows[0].GetMetricTemplateForStream("default")
+
+	prod := config.NameTemplateVars{SignalFxLabels: map[string]string{"env": "prod"}}
+	matches, err := mt.Matches(prod, 1)
+	assert.Nil(t, err)
+	assert.True(t, matches)
+	matches, err = mt.Matches(prod, -1)
+	assert.Nil(t, err)
+	assert.False(t, matches)
+	matches, err = mt.Matches(config.NameTemplateVars{SignalFxLabels: map[string]string{"env": "dev"}}, 1)
+	assert.Nil(t, err)
+	assert.False(t, matches)
+
+	_, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, "{{ and", "{{ and (", 1)))
+	assert.NotNil(t, err)
+
+	cfg, err = config.LoadConfigFromBytes([]byte(strings.Replace(configFile, `'{{ and (eq .SignalFxLabels.env "prod") (gt .Value 0.0) }}'`, "'{{ .SignalFxLabels.env }}'", 1)))
+	assert.Nil(t, err)
+	mt, _ = cfg.Flows[0].GetMetricTemplateForStream("default")
+	_, err = mt.Matches(prod, 1)
+	assert.NotNil(t, err)
+}
+
+func TestNameMapping(t *testing.T) {
+	mapping, err := config.LoadNameMappingFromBytes([]byte(`
+cpu.utilization: node_cpu_utilization_ratio
+memory.used: node_memory_used_bytes
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "node_memory_used_bytes", mapping["memory.used"])
+
+	_, err = config.LoadNameMappingFromBytes([]byte(`cpu.utilization: node.cpu.utilization`))
+	assert.NotNil(t, err)
+}
+
+func TestConfigHash(t *testing.T) {
+	hash := func(yml string) string {
+		c, err := config.LoadConfigFromBytes([]byte(yml))
+		assert.Nil(t, err)
+		h, err := c.Hash()
+		assert.Nil(t, err)
+		return h
+	}
+	a := hash(`
+sfx:
+  token: xxx
+flows:
+- name: a
+  query: data('a').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: a
+`)
+	// same config with defaults spelled out and different formatting
+	b := hash(`
+sfx: {token: xxx, realm: us1}
+flows:
+- {name: a, query: "data('a').publish()", prometheusMetricTemplates: [{type: gauge, name: a, stream: default}]}
+`)
+	c := hash(`
+sfx:
+  token: xxx
+flows:
+- name: a
+  query: data('b').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: a
+`)
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
+
+func TestDuplicateFlowNames(t *testing.T) {
+	_, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: a
+  query: data('a').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+- name: b
+  query: data('b').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+- name: a
+  query: data('c').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Duplicate flow name a, used by flows 1 and 3")
+}
+
+func TestFlowHash(t *testing.T) {
+	hash := func(sfx string, query string) string {
+		c, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  ` + sfx + `
+flows:
+- name: a
+  query: ` + query + `
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+		assert.Nil(t, err)
+		h, err := c.Flows[0].Hash()
+		assert.Nil(t, err)
+		return h
+	}
+	a := hash("token: xxx", "data('a').publish()")
+	assert.Equal(t, a, hash("{token: xxx, realm: us1}", "data('a').publish()"))
+	assert.NotEqual(t, a, hash("token: xxx", "data('b').publish()"))
+	// a rotated token restarts the flow
+	assert.NotEqual(t, a, hash("token: yyy", "data('a').publish()"))
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	load := func(expression string) error {
+		_, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+derivedMetrics:
+- name: derived
+  expression: '` + expression + `'
+`))
+		return err
+	}
+	assert.Nil(t, load(`{{ if gt (.Metric "a") 0.0 }}{{ .Metric "a" }}{{ else }}{{ .Metric "b" }}{{ end }}`))
+	assert.NotNil(t, load(`{{ .Metric .Labels.name }}`))
+	assert.NotNil(t, load(`{{ 1 }}`))
+	assert.NotNil(t, load(`{{ .Metric "a" `))
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	load := func(template string) error {
+		_, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: latency
+  query: data('latency').publish()
+  prometheusMetricTemplates:
+  - ` + template + `
+`))
+		return err
+	}
+	assert.Nil(t, load(`{type: histogram, buckets: [0.1, 0.5, 1]}`))
+	assert.NotNil(t, load(`{type: histogram}`))
+	assert.NotNil(t, load(`{type: histogram, buckets: [1, 0.5]}`))
+	assert.NotNil(t, load(`{type: histogram, buckets: [1, 1]}`))
+	assert.NotNil(t, load(`{type: gauge, buckets: [1]}`))
+	assert.NotNil(t, load(`{type: distribution, buckets: [1]}`))
+	assert.NotNil(t, load(`{name: latency}`))
+}
+
+func TestSummaryObjectives(t *testing.T) {
+	load := func(template string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: latency
+  query: data('latency').publish()
+  prometheusMetricTemplates:
+  - ` + template + `
+`))
+	}
+	c, err := load(`{type: summary}`)
+	assert.Nil(t, err)
+	assert.Equal(t, config.DefaultSummaryObjectives, c.Flows[0].MetricTemplates[0].Objectives)
+
+	c, err = load(`{type: summary, objectives: {0.5: 0.05, 0.99: 0.001}, maxAge: 5m}`)
+	assert.Nil(t, err)
+	assert.Equal(t, map[float64]float64{0.5: 0.05, 0.99: 0.001}, c.Flows[0].MetricTemplates[0].Objectives)
+	assert.Equal(t, 5*time.Minute, c.Flows[0].MetricTemplates[0].MaxAge)
+
+	_, err = load(`{type: gauge, maxAge: 5m}`)
+	assert.NotNil(t, err)
+	_, err = load(`{type: summary, objectives: {99: 0.001}}`)
+	assert.NotNil(t, err)
+	_, err = load(`{type: summary, objectives: {0.99: -0.001}}`)
+	assert.NotNil(t, err)
+	_, err = load(`{type: summary, objectives: {0: 0, 1: 0}}`)
+	assert.Nil(t, err)
+}
+
+func TestReservedLabels(t *testing.T) {
+	load := func(mode string, template string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+reservedLabels: ` + mode + `
+flows:
+- name: reserved
+  query: data('reserved').publish()
+  prometheusMetricTemplates:
+  - ` + template + `
+`))
+	}
+	c, err := load("keep", `{type: counter, labels: {job: x}}`)
+	assert.Nil(t, err)
+	assert.Contains(t, c.Flows[0].MetricTemplates[0].Labels, "job")
+
+	_, err = load("error", `{type: counter, labels: {job: x}}`)
+	assert.NotNil(t, err)
+
+	c, err = load("prefix", `{type: counter, labels: {job: x, host: y}, aggregateWithout: [job]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"sfx_job": "x", "host": "y"}, c.Flows[0].MetricTemplates[0].Labels)
+	assert.Equal(t, []string{"sfx_job"}, c.Flows[0].MetricTemplates[0].AggregateWithout)
+
+	// never valid, regardless of the mode
+	_, err = load("keep", `{type: gauge, labels: {__name__: x}}`)
+	assert.NotNil(t, err)
+	_, err = load("keep", `{type: histogram, buckets: [1], labels: {le: x}}`)
+	assert.NotNil(t, err)
+	_, err = load("keep", `{type: summary, labels: {quantile: x}}`)
+	assert.NotNil(t, err)
+	_, err = load("drop", `{type: gauge}`)
+	assert.NotNil(t, err)
+}
+
+func TestStaleAfter(t *testing.T) {
+	c, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: hosts
+  query: data('host.up').publish()
+  staleAfter: 10m
+  prometheusMetricTemplates:
+  - type: gauge
+  - type: gauge
+    stream: fast
+    staleAfter: 1m
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, c.Flows[0].MetricTemplates[0].StaleAfter)
+	assert.Equal(t, time.Minute, c.Flows[0].MetricTemplates[1].StaleAfter)
+
+	_, err = config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: hosts
+  query: data('host.up').publish()
+  staleAfter: -1m
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+	assert.NotNil(t, err)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	load := func(backoff string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: flaky
+  query: data('flaky').publish()
+  ` + backoff + `
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+	}
+	c, err := load(``)
+	assert.Nil(t, err)
+	assert.Equal(t, config.DefaultReconnectBackoff, c.Flows[0].ReconnectBackoff)
+	assert.Equal(t, config.DefaultMaxReconnectBackoff, c.Flows[0].MaxReconnectBackoff)
+
+	c, err = load(`reconnectBackoff: 5s`)
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, c.Flows[0].ReconnectBackoff)
+
+	_, err = load(`reconnectBackoff: 5m`)
+	assert.NotNil(t, err)
+}
+
+func TestTLS(t *testing.T) {
+	for tls, valid := range map[string]bool{
+		"certFile: tls.crt\n  keyFile: tls.key":                         true,
+		"certFile: tls.crt\n  keyFile: tls.key\n  clientCAFile: ca.crt": true,
+		"certFile: tls.crt":    false,
+		"keyFile: tls.key":     false,
+		"clientCAFile: ca.crt": false,
+	} {
+		_, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+tls:
+  ` + tls + `
+`))
+		assert.Equal(t, valid, err == nil, tls)
+	}
+}
+
+func TestDebugSampleRate(t *testing.T) {
+	for rate, valid := range map[string]bool{"0": true, "0.01": true, "1": true, "-0.5": false, "1.5": false} {
+		_, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: sampled
+  query: data('sampled').publish()
+  debugSampleRate: ` + rate + `
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+		assert.Equal(t, valid, err == nil, rate)
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	load := func(settings string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: partial
+  query: data('partial').publish()
+` + settings + `
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+	}
+	c, err := load("")
+	assert.Nil(t, err)
+	assert.Equal(t, config.LabelErrorsStrict, c.Flows[0].LabelErrors)
+
+	_, err = load("  labelErrors: drop")
+	assert.Nil(t, err)
+	_, err = load("  labelErrors: fallback\n  labelFallback: unknown")
+	assert.Nil(t, err)
+
+	// fallback needs a value to fall back to
+	_, err = load("  labelErrors: fallback")
+	assert.NotNil(t, err)
+	_, err = load("  labelErrors: lenient")
+	assert.NotNil(t, err)
+}
+
+func TestStaticLabels(t *testing.T) {
+	load := func(staticLabels string, labels string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flowLabel: true
+flows:
+- name: static
+  query: data('static').publish()
+  staticLabels: ` + staticLabels + `
+  prometheusMetricTemplates:
+  - type: histogram
+    buckets: [1]
+    labels: ` + labels + `
+`))
+	}
+	c, err := load(`{env: prod}`, `{host: x}`)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"env": "prod"}, c.Flows[0].StaticLabels)
+
+	for _, invalid := range []struct{ staticLabels, labels string }{
+		{`{env: prod}`, `{env: x}`},
+		{`{flow: x}`, `{}`},
+		{`{le: x}`, `{}`},
+		{`{__env: x}`, `{}`},
+		{`{env-name: x}`, `{}`},
+	} {
+		_, err := load(invalid.staticLabels, invalid.labels)
+		assert.NotNil(t, err, invalid.staticLabels)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "config-*.yml")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`
+sfx:
+  token: xxx
+flows:
+- name: valid
+  query: data('a').publish('a')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+- name: unmapped
+  query: data('a').publish('a'); data('b').publish('b')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+- name: invalid-label
+  query: data('a').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host-name: x
+- query: data('a').publish()
+`)
+	assert.Nil(t, err)
+	file.Close()
+
+	checks, err := config.CheckConfig(file.Name())
+	assert.Nil(t, err)
+	assert.Len(t, checks, 4)
+	assert.Nil(t, checks[0].Err)
+	assert.Contains(t, checks[1].Err.Error(), "without a template: b")
+	assert.Contains(t, checks[2].Err.Error(), "host-name")
+	assert.Contains(t, checks[3].Err.Error(), "has no name")
+
+	_, err = config.CheckConfig(file.Name() + ".missing")
+	assert.NotNil(t, err)
+}
+
+func TestInvalidMetricNames(t *testing.T) {
+	for name, valid := range map[string]bool{"http_requests_total": true, "node:cpu:rate5m": true, "cpu.utilization": false, "{{ .SignalFxMetricName }}_ratio": true} {
+		_, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+flows:
+- name: named
+  query: data('named').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: '` + name + `'
+`))
+		assert.Equal(t, valid, err == nil, name)
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	load := func(sfx string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  ` + sfx + `
+flows: []
+`))
+	}
+	dir, err := ioutil.TempDir("", "token")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("from-file\n"), 0600))
+	os.Setenv("SFXPE_TEST_TOKEN", "from-env")
+	defer os.Unsetenv("SFXPE_TEST_TOKEN")
+
+	c, err := load(`{token: literal}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "literal", c.Sfx.Token)
+
+	c, err = load(`{tokenEnv: SFXPE_TEST_TOKEN}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env", c.Sfx.Token)
+
+	c, err = load(`{tokenFile: ` + tokenFile + `}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "from-file", c.Sfx.Token)
+
+	_, err = load(`{tokenEnv: SFXPE_TEST_TOKEN, tokenFile: ` + tokenFile + `}`)
+	assert.NotNil(t, err)
+	_, err = load(`{token: literal, tokenEnv: SFXPE_TEST_TOKEN}`)
+	assert.NotNil(t, err)
+	_, err = load(`{tokenEnv: SFXPE_TEST_UNSET}`)
+	assert.NotNil(t, err)
+	_, err = load(`{tokenFile: ` + filepath.Join(dir, "missing") + `}`)
+	assert.NotNil(t, err)
+	_, err = load(`{realm: eu0}`)
+	assert.NotNil(t, err)
+}
+
+func TestCredentials(t *testing.T) {
+	load := func(flows string) (*config.Config, error) {
+		return config.LoadConfigFromBytes([]byte(`
+sfx:
+  realm: us1
+  maxConcurrentPrograms: 4
+credentials:
+  team_a:
+    realm: eu0
+    token: aaa
+    maxConcurrentPrograms: 2
+  team_b:
+    token: bbb
+flows:
+` + flows))
+	}
+	c, err := load(`
+- name: a
+  query: data('a').publish()
+  credential: team_a
+  prometheusMetricTemplates:
+  - type: gauge
+- name: b
+  query: data('b').publish()
+  credential: team_b
+  prometheusMetricTemplates:
+  - type: gauge
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, "eu0", c.Flows[0].Realm())
+	assert.Equal(t, "aaa", c.Flows[0].Token())
+	assert.Equal(t, "us1", c.Flows[1].Realm())
+	assert.Equal(t, "bbb", c.Flows[1].Token())
+	assert.Equal(t, map[string]int{"us1": 4, "eu0": 2}, c.RealmLimits())
+
+	_, err = load(`
+- name: c
+  query: data('c').publish()
+  credential: team_c
+  prometheusMetricTemplates:
+  - type: gauge
+`)
+	assert.NotNil(t, err)
+
+	// there's no sfx token to fall back to
+	_, err = load(`
+- name: d
+  query: data('d').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`)
+	assert.NotNil(t, err)
+}
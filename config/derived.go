@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/prometheus/common/model"
+)
+
+// DerivedMetric is a gauge computed at scrape time from the exposed metrics
+type DerivedMetric struct {
+	Name       string   `yaml:"name"`
+	Help       string   `yaml:"help"`
+	Expression string   `yaml:"expression"`
+	On         []string `yaml:"on"`
+	template   *template.Template
+	metrics    []string
+}
+
+// DerivedMetricVars is the data of a derived metric expression for one group
+// of series, i.e. one combination of values of the On labels.
+//
+// .Metric "name" is the sum of the series of a metric in the group, so
+// expressions work like `sum by (on) (...)` in PromQL.
+type DerivedMetricVars struct {
+	Labels map[string]string
+	Values map[string]float64
+}
+
+// Metric returns the summed value of a metric in the group, which fails the
+// evaluation of the group if the metric has no series in it
+func (v DerivedMetricVars) Metric(name string) (float64, error) {
+	value, ok := v.Values[name]
+	if !ok {
+		return 0, fmt.Errorf("no series of %s", name)
+	}
+	return value, nil
+}
+
+func (dm *DerivedMetric) Validate() error {
+	if !model.IsValidMetricName(model.LabelValue(dm.Name)) {
+		return fmt.Errorf("Invalid derived metric name %q", dm.Name)
+	}
+	for _, label := range dm.On {
+		if !model.LabelName(label).IsValid() {
+			return fmt.Errorf("Invalid label %q in derived metric %s", label, dm.Name)
+		}
+	}
+	if dm.Help == "" {
+		dm.Help = "Derived from " + dm.Expression
+	}
+	tmpl, err := parseValueTemplate(dm.Expression)
+	if err != nil {
+		return fmt.Errorf("Invalid expression in derived metric %s - %s", dm.Name, err)
+	}
+	metrics, err := referencedMetrics(tmpl.Tree.Root)
+	if err != nil {
+		return fmt.Errorf("Invalid expression in derived metric %s - %s", dm.Name, err)
+	}
+	if len(metrics) == 0 {
+		return fmt.Errorf("Expression of derived metric %s references no metric", dm.Name)
+	}
+	dm.template = tmpl
+	dm.metrics = metrics
+	return nil
+}
+
+// Metrics returns the names of the metrics the expression references
+func (dm *DerivedMetric) Metrics() []string {
+	return dm.metrics
+}
+
+// Evaluate computes the value of the derived metric for a group of series
+func (dm *DerivedMetric) Evaluate(vars DerivedMetricVars) (float64, error) {
+	var buffer bytes.Buffer
+	if err := dm.template.Execute(&buffer, vars); err != nil {
+		return 0, err
+	}
+	rendered := strings.TrimSpace(buffer.String())
+	result, err := strconv.ParseFloat(rendered, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Value %q is not a number", rendered)
+	}
+	return result, nil
+}
+
+// referencedMetrics collects the metric names of all .Metric calls, which
+// have to be string literals so the metrics are known upfront
+func referencedMetrics(node parse.Node) ([]string, error) {
+	metrics := []string{}
+	var walk func(node parse.Node) error
+	walk = func(node parse.Node) error {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return nil
+			}
+			for _, child := range n.Nodes {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return nil
+			}
+			for _, cmd := range n.Cmds {
+				if err := walk(cmd); err != nil {
+					return err
+				}
+			}
+		case *parse.CommandNode:
+			if field, ok := n.Args[0].(*parse.FieldNode); ok && len(field.Ident) == 1 && field.Ident[0] == "Metric" {
+				if len(n.Args) != 2 {
+					return fmt.Errorf(".Metric takes exactly one metric name")
+				}
+				name, ok := n.Args[1].(*parse.StringNode)
+				if !ok {
+					return fmt.Errorf(".Metric takes a quoted metric name, got %s", n.Args[1])
+				}
+				metrics = append(metrics, name.Text)
+				return nil
+			}
+			for _, arg := range n.Args {
+				if err := walk(arg); err != nil {
+					return err
+				}
+			}
+		case *parse.IfNode:
+			return walkBranch(walk, &n.BranchNode)
+		case *parse.RangeNode:
+			return walkBranch(walk, &n.BranchNode)
+		case *parse.WithNode:
+			return walkBranch(walk, &n.BranchNode)
+		}
+		return nil
+	}
+	err := walk(node)
+	return metrics, err
+}
+
+func walkBranch(walk func(parse.Node) error, n *parse.BranchNode) error {
+	for _, child := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := walk(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
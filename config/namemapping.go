@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadNameMappingFromBytes parses a mapping of SignalFX metric names to Prometheus metric names
+func LoadNameMappingFromBytes(mappingBytes []byte) (map[string]string, error) {
+	mapping := map[string]string{}
+	if err := yaml.Unmarshal(mappingBytes, &mapping); err != nil {
+		return nil, err
+	}
+	for sfxName, name := range mapping {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return nil, fmt.Errorf("Invalid Prometheus metric name %q for SignalFX metric %s", name, sfxName)
+		}
+	}
+	return mapping, nil
+}
+
+func LoadNameMapping(file string) (map[string]string, error) {
+	mappingBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return LoadNameMappingFromBytes(mappingBytes)
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	callPattern = regexp.MustCompile(`(\.?)\s*([A-Za-z_][A-Za-z0-9_]*)\s*\(`)
+	defPattern  = regexp.MustCompile(`\bdef\s+([A-Za-z_][A-Za-z0-9_]*)\s*\(`)
+
+	// publish() without arguments or with a literal label
+	publishPattern = regexp.MustCompile(`\.\s*publish\s*\(\s*(?:(\))|(?:label\s*=\s*)?(?:'([^'\\]*)'|"([^"\\]*)"))`)
+
+	knownFunctions = toSet(
+		"abs", "alerts", "ceil", "combine", "const", "count", "data", "detect",
+		"dimensions", "events", "exp", "filter", "floor", "graphite", "lasting",
+		"log", "log10", "max", "mean", "median", "min", "newrelic", "partition_filter",
+		"percentile", "pow", "print", "range", "sqrt", "stddev", "str", "sum",
+		"threshold", "union", "variance", "when", "float", "int", "len",
+	)
+
+	knownMethods = toSet(
+		"abs", "above", "below", "between", "bottom", "ceil", "count", "delta",
+		"dimensions", "double_ewma", "equals", "ewma", "exp", "fill", "floor",
+		"integrate", "kpss", "log", "log10", "map", "max", "mean", "mean_plus_stddev",
+		"median", "min", "not_between", "not_equals", "percentile", "pow", "promote",
+		"publish", "random", "rateofchange", "sample_stddev", "sample_variance",
+		"scale", "size", "sqrt", "stddev", "sum", "timeshift", "top", "union",
+		"variance", "get", "lasting", "format",
+	)
+
+	keywords = toSet("and", "or", "not", "if", "elif", "in", "is", "return", "lambda")
+)
+
+func toSet(items ...string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// stripStrings replaces string literals and comments with blanks, so brackets
+// and calls within them are not considered
+func stripStrings(query string) (string, error) {
+	var out strings.Builder
+	var quote rune
+	escaped := false
+	comment := false
+	for _, c := range query {
+		switch {
+		case comment:
+			if c == '\n' {
+				comment = false
+				out.WriteRune(c)
+			}
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+				out.WriteRune(c)
+			} else if c == '\n' {
+				return "", fmt.Errorf("unterminated string literal")
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			out.WriteRune(c)
+		case c == '#':
+			comment = true
+		default:
+			out.WriteRune(c)
+		}
+	}
+	if quote != 0 {
+		return "", fmt.Errorf("unterminated string literal")
+	}
+	return out.String(), nil
+}
+
+func checkBrackets(query string) error {
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	stack := []rune{}
+	for _, c := range query {
+		switch c {
+		case '(', '[', '{':
+			stack = append(stack, c)
+		case ')', ']', '}':
+			if len(stack) == 0 || stack[len(stack)-1] != pairs[c] {
+				return fmt.Errorf("unbalanced %c", c)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed %c", stack[len(stack)-1])
+	}
+	return nil
+}
+
+// LintQuery performs a best effort syntactic check of a SignalFlow program
+// without executing it. An error is returned for programs that can not work,
+// like unbalanced brackets or programs that never publish data. Warnings are
+// returned for suspicious programs, like calls to unknown functions.
+func LintQuery(query string) ([]string, error) {
+	code, err := stripStrings(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBrackets(code); err != nil {
+		return nil, err
+	}
+
+	userFunctions := map[string]bool{}
+	for _, match := range defPattern.FindAllStringSubmatch(code, -1) {
+		userFunctions[match[1]] = true
+	}
+
+	published := false
+	warnings := []string{}
+	for _, match := range callPattern.FindAllStringSubmatch(code, -1) {
+		isMethod, name := match[1] == ".", match[2]
+		if isMethod && name == "publish" {
+			published = true
+		}
+		if isMethod && !knownMethods[name] {
+			warnings = append(warnings, fmt.Sprintf("unknown method %s()", name))
+		} else if !isMethod && !knownFunctions[name] && !userFunctions[name] && !keywords[name] {
+			warnings = append(warnings, fmt.Sprintf("unknown function %s()", name))
+		}
+	}
+	if !published {
+		return warnings, fmt.Errorf("program does not publish any data, publish() is missing")
+	}
+	return warnings, nil
+}
+
+// PublishedStreams returns the stream labels a SignalFlow program publishes
+// to, in order and without duplicates. publish() without a label publishes to
+// the default stream, labels that aren't string literals are not known.
+func PublishedStreams(query string) []string {
+	streams := []string{}
+	seen := map[string]bool{}
+	for _, match := range publishPattern.FindAllStringSubmatch(query, -1) {
+		stream := match[2] + match[3]
+		if match[1] != "" {
+			stream = "default"
+		}
+		if stream != "" && !seen[stream] {
+			seen[stream] = true
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
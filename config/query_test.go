@@ -0,0 +1,70 @@
+package config_test
+
+import (
+	"signalfx-prometheus-exporter/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintValidQuery(t *testing.T) {
+	warnings, err := config.LintQuery(`
+# sum up failures
+def failures(name):
+    return data(name).sum(by=['cp_testname'])
+failures('catchpoint.counterfailedrequests').publish("gauge", prometheus_name="catchpoint_failures_total")
+`)
+	assert.Nil(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestLintUnbalancedQuery(t *testing.T) {
+	_, err := config.LintQuery(`data('foo'.publish()`)
+	assert.NotNil(t, err)
+
+	_, err = config.LintQuery(`data('foo')].publish()`)
+	assert.NotNil(t, err)
+}
+
+func TestLintBracketsInStringsAreIgnored(t *testing.T) {
+	_, err := config.LintQuery(`data('foo(').publish(label="[")`)
+	assert.Nil(t, err)
+}
+
+func TestLintUnterminatedString(t *testing.T) {
+	_, err := config.LintQuery(`data('foo).publish()`)
+	assert.NotNil(t, err)
+}
+
+func TestLintMissingPublish(t *testing.T) {
+	_, err := config.LintQuery(`data('foo').sum()`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "publish")
+}
+
+func TestLintUnknownFunctions(t *testing.T) {
+	warnings, err := config.LintQuery(`dta('foo').smu().publish()`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unknown function dta()", "unknown method smu()"}, warnings)
+}
+
+func TestFlowWithUnpublishedQueryFailsToLoad(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: unpublished
+  query: data('foo')
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+}
+
+func TestPublishedStreams(t *testing.T) {
+	query := `A = data('a').publish()
+B = data('b').publish('b')
+C = data('c').publish(label="c", enable=False)
+data('d').publish(label=name)
+data('e').publish(label='b')`
+	assert.Equal(t, []string{"default", "b", "c"}, config.PublishedStreams(query))
+}
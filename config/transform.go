@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ValueTemplateVars additionally exposes the payload value to value templates
+type ValueTemplateVars struct {
+	NameTemplateVars
+	Value float64
+}
+
+// valueFuncs are the functions available in value templates, e.g. transforms
+var valueFuncs = template.FuncMap{
+	"add": func(a, b float64) float64 { return a + b },
+	"sub": func(a, b float64) float64 { return a - b },
+	"mul": func(a, b float64) float64 { return a * b },
+	"div": func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	},
+	"min":   math.Min,
+	"max":   math.Max,
+	"abs":   math.Abs,
+	"clamp": func(lower, upper, v float64) float64 { return math.Max(lower, math.Min(upper, v)) },
+	"float": func(s string) (float64, error) {
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	},
+}
+
+func parseValueTemplate(text string) (*template.Template, error) {
+	return template.New("x").Funcs(valueFuncs).Parse(text)
+}
+
+func renderValue(tmpl *template.Template, data NameTemplateVars, value float64) (float64, error) {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, ValueTemplateVars{NameTemplateVars: data, Value: value}); err != nil {
+		return 0, err
+	}
+	rendered := strings.TrimSpace(buffer.String())
+	result, err := strconv.ParseFloat(rendered, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Value %q is not a number", rendered)
+	}
+	return result, nil
+}
+
+// Matches evaluates the when predicate of the metric for a payload, which
+// has to render to a boolean. Metrics without predicate match all payloads.
+func (pm *PrometheusMetric) Matches(data NameTemplateVars, value float64) (bool, error) {
+	if pm.whenTemplate == nil {
+		return true, nil
+	}
+	var buffer bytes.Buffer
+	if err := pm.whenTemplate.Execute(&buffer, ValueTemplateVars{NameTemplateVars: data, Value: value}); err != nil {
+		return false, err
+	}
+	rendered := strings.TrimSpace(buffer.String())
+	matches, err := strconv.ParseBool(rendered)
+	if err != nil {
+		return false, fmt.Errorf("Predicate result %q is not a boolean", rendered)
+	}
+	return matches, nil
+}
+
+// TransformValue applies the transform of the metric to a payload value
+func (pm *PrometheusMetric) TransformValue(data NameTemplateVars, value float64) (float64, error) {
+	if pm.transformTemplate == nil {
+		return value, nil
+	}
+	return renderValue(pm.transformTemplate, data, value)
+}
+
+// GetIncrement renders the amount a counter is increased by for a payload,
+// which is the payload value itself unless an increment is configured
+func (pm *PrometheusMetric) GetIncrement(data NameTemplateVars, value float64) (float64, error) {
+	if pm.incrementTemplate == nil {
+		return value, nil
+	}
+	increment, err := renderValue(pm.incrementTemplate, data, value)
+	if err != nil {
+		return 0, err
+	}
+	return increment, CheckIncrement(increment)
+}
+
+// CheckIncrement fails for increments a counter can't be increased by, which
+// would make it panic
+func CheckIncrement(increment float64) error {
+	if increment < 0 || math.IsNaN(increment) {
+		return fmt.Errorf("Increment must not be negative, got %v", increment)
+	}
+	return nil
+}
+
+// ScaleValue converts the value of a gauge, histogram or summary with the
+// scale and offset of the metric
+func (pm *PrometheusMetric) ScaleValue(value float64) float64 {
+	return pm.ScaleIncrement(value) + pm.Offset
+}
+
+// ScaleIncrement converts the increment of a counter with the scale of the
+// metric, the offset is ignored so counters stay monotonic
+func (pm *PrometheusMetric) ScaleIncrement(increment float64) float64 {
+	if pm.Scale == nil {
+		return increment
+	}
+	return increment * *pm.Scale
+}
@@ -3,13 +3,19 @@ module signalfx-prometheus-exporter
 go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.43.10
+	github.com/fsnotify/fsnotify v1.5.1
+	github.com/golang/protobuf v1.5.2
 	github.com/gorilla/mux v1.8.0
 	github.com/prometheus/client_golang v1.12.1
 	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.32.1
+	github.com/segmentio/kafka-go v0.4.30
 	github.com/signalfx/signalfx-go v1.8.7
 	github.com/spf13/cobra v1.3.0
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/zap v1.17.0
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/time v0.0.0-20220210224613-90d013bbcef8
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
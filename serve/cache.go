@@ -0,0 +1,128 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// CachingGatherer serves the result of the wrapped gatherer for the duration
+// of the TTL before gathering again. Scrapes within the TTL are served from
+// the cache, trading freshness for speed on large registries.
+type CachingGatherer struct {
+	Gatherer prometheus.Gatherer
+	TTL      time.Duration
+
+	mu         sync.Mutex
+	mfs        []*dto.MetricFamily
+	err        error
+	gatheredAt time.Time
+}
+
+func (cg *CachingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+
+	if cg.TTL > 0 && !cg.gatheredAt.IsZero() && time.Since(cg.gatheredAt) < cg.TTL {
+		return cg.mfs, cg.err
+	}
+	cg.mfs, cg.err = cg.Gatherer.Gather()
+	cg.gatheredAt = time.Now()
+	return cg.mfs, cg.err
+}
+
+// ExpositionCache gathers the wrapped gatherer on a fixed interval in the
+// background and keeps the metric families as well as their serialized text
+// exposition. Scrapes are served from the cache and never wait for a gather.
+type ExpositionCache struct {
+	Gatherer prometheus.Gatherer
+
+	mu          sync.RWMutex
+	mfs         []*dto.MetricFamily
+	text        []byte
+	err         error
+	refreshedAt time.Time
+}
+
+func (ec *ExpositionCache) Refresh() error {
+	mfs, err := ec.Gatherer.Gather()
+	var buffer bytes.Buffer
+	enc := expfmt.NewEncoder(&buffer, expfmt.FmtText)
+	for _, mf := range mfs {
+		if encErr := enc.Encode(mf); encErr != nil && err == nil {
+			err = encErr
+		}
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.mfs = mfs
+	ec.text = buffer.Bytes()
+	ec.err = err
+	ec.refreshedAt = time.Now()
+	return err
+}
+
+func (ec *ExpositionCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := ec.Refresh(); err != nil {
+			Log().Errorf("failed to refresh exposition cache: %+s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ec *ExpositionCache) Gather() ([]*dto.MetricFamily, error) {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return ec.mfs, ec.err
+}
+
+// Age returns the time since the last refresh of the cache
+func (ec *ExpositionCache) Age() time.Duration {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	if ec.refreshedAt.IsZero() {
+		return 0
+	}
+	return time.Since(ec.refreshedAt)
+}
+
+// ServeHTTP serves the cached text exposition. scrapes fail until the first
+// refresh and while the last refresh failed, and scrapers asking for another
+// format get the cached metric families encoded on demand.
+func (ec *ExpositionCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ec.mu.RLock()
+	refreshed, text, err := !ec.refreshedAt.IsZero(), ec.text, ec.err
+	ec.mu.RUnlock()
+	if !refreshed {
+		http.Error(w, "The exposition cache was not refreshed yet", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("The last refresh of the exposition cache failed - %s", err), http.StatusInternalServerError)
+		return
+	}
+	if expfmt.Negotiate(r.Header) != expfmt.FmtText {
+		promhttp.HandlerFor(ec, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	w.Write(text)
+}
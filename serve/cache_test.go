@@ -0,0 +1,94 @@
+package serve_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"signalfx-prometheus-exporter/serve"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachingGathererServesFromCache(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "some_gauge"})
+	registry.MustRegister(gauge)
+	gauge.Set(1)
+
+	cg := &serve.CachingGatherer{Gatherer: registry, TTL: time.Hour}
+	mfs, err := cg.Gather()
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, mfs[0].Metric[0].GetGauge().GetValue())
+
+	gauge.Set(2)
+	mfs, err = cg.Gather()
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, mfs[0].Metric[0].GetGauge().GetValue())
+}
+
+func TestCachingGathererDisabled(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "some_gauge"})
+	registry.MustRegister(gauge)
+	gauge.Set(1)
+
+	cg := &serve.CachingGatherer{Gatherer: registry}
+	_, err := cg.Gather()
+	assert.Nil(t, err)
+
+	gauge.Set(2)
+	mfs, err := cg.Gather()
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, mfs[0].Metric[0].GetGauge().GetValue())
+}
+
+func TestExpositionCache(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "some_gauge"})
+	registry.MustRegister(gauge)
+	gauge.Set(1)
+
+	ec := &serve.ExpositionCache{Gatherer: registry}
+	rec := httptest.NewRecorder()
+	ec.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	assert.Nil(t, ec.Refresh())
+	gauge.Set(2)
+
+	mfs, err := ec.Gather()
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, mfs[0].Metric[0].GetGauge().GetValue())
+
+	rec = httptest.NewRecorder()
+	ec.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "some_gauge 1")
+
+	assert.Nil(t, ec.Refresh())
+	rec = httptest.NewRecorder()
+	ec.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), "some_gauge 2")
+
+	// other formats are negotiated like with promhttp
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	ec.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "application/vnd.google.protobuf")
+}
+
+func TestExpositionCacheFailedRefresh(t *testing.T) {
+	ec := &serve.ExpositionCache{Gatherer: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, fmt.Errorf("gather failed")
+	})}
+	assert.NotNil(t, ec.Refresh())
+	rec := httptest.NewRecorder()
+	ec.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
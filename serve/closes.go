@@ -0,0 +1,55 @@
+package serve
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/signalfx/signalfx-go/signalflow"
+)
+
+const (
+	// how a SignalFlow stream ended
+	closeCompleted = "completed"
+	closeAuth      = "auth"
+	closeProgram   = "program"
+	closeTransient = "transient"
+
+	// the code label of closes without a SignalFlow error code
+	closeCodeNone = "none"
+)
+
+var errStreamClosed = errors.New("SignalFlow stream closed unexpectedly")
+
+// classifyClose maps the error a stream ended with to how the flow proceeds.
+//
+// completed streams of bounded programs and rejected programs are final, auth
+// errors are final too and need a new token. everything else, i.e. server
+// errors, connection failures and streams that just stopped, is retried.
+func classifyClose(err error) (reason string, code string) {
+	if err == nil {
+		return closeCompleted, closeCodeNone
+	}
+	var compErr *signalflow.ComputationError
+	if !errors.As(err, &compErr) {
+		return closeTransient, closeCodeNone
+	}
+	code = strconv.Itoa(compErr.Code)
+	switch {
+	case compErr.Code == 401 || compErr.Code == 403:
+		return closeAuth, code
+	case compErr.Code >= 400 && compErr.Code < 500:
+		return closeProgram, code
+	default:
+		return closeTransient, code
+	}
+}
+
+// nextBackoff doubles the wait before the next reconnect, up to max
+func nextBackoff(backoff time.Duration, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
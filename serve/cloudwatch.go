@@ -0,0 +1,184 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// CloudWatch limits of a single PutMetricData call and a single datum
+	cloudwatchMaxDatums     = 20
+	cloudwatchMaxDimensions = 10
+)
+
+var (
+	// cloudwatch push observability
+	cloudwatchPushesFailed   prometheus.Counter
+	cloudwatchMetricsWritten prometheus.Counter
+	cloudwatchMetricsSkipped *prometheus.CounterVec
+)
+
+// CloudWatchDatums turns metric families into CloudWatch metric data, with
+// one dimension per non-empty label. Metrics with more labels than CloudWatch
+// supports keep the dimensions of the first labels by name.
+//
+// CloudWatch rejects NaN and infinite values, so these are skipped. metrics
+// whose dimensions are the same as the ones of an earlier metric after the cut
+// would overwrite its value and are skipped as collisions, along with the
+// number of skipped metrics of both kinds.
+func CloudWatchDatums(mfs []*dto.MetricFamily, ts time.Time) (datums []*cloudwatch.MetricDatum, nonFinite int, collisions int) {
+	datums = []*cloudwatch.MetricDatum{}
+	seen := make(map[string]bool)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				nonFinite++
+				continue
+			}
+
+			labels := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				// CloudWatch rejects empty dimension values
+				if l.GetValue() != "" {
+					labels = append(labels, l)
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+			if len(labels) > cloudwatchMaxDimensions {
+				labels = labels[:cloudwatchMaxDimensions]
+			}
+			dimensions := make([]*cloudwatch.Dimension, len(labels))
+			key := []string{mf.GetName()}
+			for i, l := range labels {
+				dimensions[i] = &cloudwatch.Dimension{Name: aws.String(l.GetName()), Value: aws.String(l.GetValue())}
+				key = append(key, l.GetName(), l.GetValue())
+			}
+			seriesKey := strings.Join(key, "\xff")
+			if seen[seriesKey] {
+				collisions++
+				continue
+			}
+			seen[seriesKey] = true
+
+			datums = append(datums, &cloudwatch.MetricDatum{
+				MetricName: aws.String(mf.GetName()),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(ts),
+				Value:      aws.Float64(value),
+			})
+		}
+	}
+	return datums, nonFinite, collisions
+}
+
+// pushCloudWatch writes all metrics in batches. a failed batch doesn't hold
+// back the remaining ones, the push fails with the last error instead.
+func pushCloudWatch(cfg config.CloudWatch, client cloudwatchiface.CloudWatchAPI, gatherer prometheus.Gatherer) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	datums, nonFinite, collisions := CloudWatchDatums(mfs, time.Now())
+	cloudwatchMetricsSkipped.WithLabelValues("non_finite").Add(float64(nonFinite))
+	cloudwatchMetricsSkipped.WithLabelValues("dimension_collision").Add(float64(collisions))
+	if collisions > 0 {
+		Log().Warnf("Skipped %d metrics whose dimensions collide after cutting them to the %d supported by CloudWatch", collisions, cloudwatchMaxDimensions)
+	}
+	failed := 0
+	var lastErr error
+	for start := 0; start < len(datums); start += cloudwatchMaxDatums {
+		end := start + cloudwatchMaxDatums
+		if end > len(datums) {
+			end = len(datums)
+		}
+		_, err := client.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(cfg.Namespace),
+			MetricData: datums[start:end],
+		})
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		cloudwatchMetricsWritten.Add(float64(end - start))
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%d of %d batches failed, last error - %s", failed, (len(datums)+cloudwatchMaxDatums-1)/cloudwatchMaxDatums, lastErr)
+	}
+	return nil
+}
+
+func setupCloudWatch(cfg config.CloudWatch, ctx context.Context) {
+	cloudwatchPushesFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_cloudwatch_pushes_failed_total",
+		Help: "Number of failed pushes to CloudWatch",
+	})
+	cloudwatchMetricsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_cloudwatch_metrics_written_total",
+		Help: "Number of metrics written to CloudWatch",
+	})
+	cloudwatchMetricsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_cloudwatch_metrics_skipped_total",
+		Help: "Number of metrics not written to CloudWatch, because of a NaN or infinite value or dimensions colliding with another metric",
+	}, []string{"reason"})
+	prometheus.MustRegister(cloudwatchPushesFailed)
+	prometheus.MustRegister(cloudwatchMetricsWritten)
+	prometheus.MustRegister(cloudwatchMetricsSkipped)
+
+	// credentials are resolved by the default chain of the AWS SDK
+	awsConfig := aws.NewConfig()
+	if cfg.Region != "" {
+		awsConfig = awsConfig.WithRegion(cfg.Region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		Log().Errorf("failed to create AWS session, CloudWatch push disabled: %+s", err)
+		return
+	}
+	client := cloudwatch.New(sess)
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := pushCloudWatch(cfg, client, sfxBaseGatherer); err != nil {
+					cloudwatchPushesFailed.Inc()
+					Log().Errorf("CloudWatch push to namespace %s failed: %+s", cfg.Namespace, err)
+				}
+			}
+		}
+	}()
+	Log().Infof("Pushing metrics to CloudWatch namespace %s every %v", cfg.Namespace, cfg.Interval)
+}
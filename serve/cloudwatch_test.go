@@ -0,0 +1,74 @@
+package serve_test
+
+import (
+	"fmt"
+	"math"
+	"signalfx-prometheus-exporter/serve"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudWatchDatums(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "some_gauge"},
+		[]string{"instance", "env", "zone"},
+	)
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("host.example.com", "prod", "").Set(1.5)
+
+	mfs, err := registry.Gather()
+	assert.Nil(t, err)
+	datums, _, _ := serve.CloudWatchDatums(mfs, time.Unix(1000, 0))
+	assert.Len(t, datums, 1)
+	assert.Equal(t, "some_gauge", *datums[0].MetricName)
+	assert.Equal(t, 1.5, *datums[0].Value)
+	assert.Equal(t, time.Unix(1000, 0), *datums[0].Timestamp)
+	// empty labels are no dimensions
+	assert.Len(t, datums[0].Dimensions, 2)
+	assert.Equal(t, "env", *datums[0].Dimensions[0].Name)
+	assert.Equal(t, "prod", *datums[0].Dimensions[0].Value)
+}
+
+func TestCloudWatchDimensionLimit(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	labelNames := []string{}
+	labelValues := []string{}
+	for i := 0; i < 15; i++ {
+		labelNames = append(labelNames, fmt.Sprintf("label_%02d", i))
+		labelValues = append(labelValues, "value")
+	}
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "wide_counter"}, labelNames)
+	registry.MustRegister(counter)
+	counter.WithLabelValues(labelValues...).Add(3)
+	// only differs in a label beyond the limit
+	labelValues[14] = "other"
+	counter.WithLabelValues(labelValues...).Add(4)
+
+	mfs, err := registry.Gather()
+	assert.Nil(t, err)
+	datums, _, collisions := serve.CloudWatchDatums(mfs, time.Now())
+	assert.Len(t, datums, 1)
+	assert.Equal(t, 1, collisions)
+	assert.Len(t, datums[0].Dimensions, 10)
+	assert.Equal(t, "label_09", *datums[0].Dimensions[9].Name)
+}
+
+func TestCloudWatchSkipsNonFinite(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "odd_gauge"}, []string{"kind"})
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("nan").Set(math.NaN())
+	gauge.WithLabelValues("inf").Set(math.Inf(-1))
+	gauge.WithLabelValues("finite").Set(2)
+
+	mfs, err := registry.Gather()
+	assert.Nil(t, err)
+	datums, nonFinite, _ := serve.CloudWatchDatums(mfs, time.Now())
+	assert.Len(t, datums, 1)
+	assert.Equal(t, 2, nonFinite)
+	assert.Equal(t, 2.0, *datums[0].Value)
+}
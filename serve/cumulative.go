@@ -0,0 +1,19 @@
+package serve
+
+// cumulativeIncrement turns the running totals SignalFX reports for cumulative
+// counters into increments, given the last total of the time series if there is
+// one. a total lower than the last one is treated as a reset of the source
+// counter. the first total of a time series either initializes the counter with
+// it, or only serves as the baseline for the following increments.
+func cumulativeIncrement(last float64, seen bool, total float64, initializeWithFirst bool) float64 {
+	switch {
+	case !seen && initializeWithFirst:
+		return total
+	case !seen:
+		return 0
+	case total < last:
+		return total
+	default:
+		return total - last
+	}
+}
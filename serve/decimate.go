@@ -0,0 +1,69 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GaugeDecimator limits how often a gauge is set. Updates arriving within the
+// interval after the last set are held back and only the latest one is
+// applied once the interval has passed.
+type GaugeDecimator struct {
+	mu     sync.Mutex
+	gauges map[prometheus.Gauge]*decimatedGauge
+}
+
+type decimatedGauge struct {
+	lastSet   time.Time
+	pending   float64
+	scheduled bool
+}
+
+func NewGaugeDecimator() *GaugeDecimator {
+	return &GaugeDecimator{gauges: make(map[prometheus.Gauge]*decimatedGauge)}
+}
+
+func (gd *GaugeDecimator) Set(g prometheus.Gauge, value float64, interval time.Duration) {
+	if interval <= 0 {
+		g.Set(value)
+		return
+	}
+
+	gd.mu.Lock()
+	defer gd.mu.Unlock()
+	dg, ok := gd.gauges[g]
+	if !ok {
+		dg = &decimatedGauge{}
+		gd.gauges[g] = dg
+	}
+
+	now := time.Now()
+	if dg.scheduled {
+		dg.pending = value
+		return
+	}
+	if elapsed := now.Sub(dg.lastSet); elapsed >= interval {
+		g.Set(value)
+		dg.lastSet = now
+		return
+	}
+
+	dg.pending = value
+	dg.scheduled = true
+	time.AfterFunc(dg.lastSet.Add(interval).Sub(now), func() {
+		gd.mu.Lock()
+		defer gd.mu.Unlock()
+		g.Set(dg.pending)
+		dg.lastSet = time.Now()
+		dg.scheduled = false
+	})
+}
+
+// Forget drops the decimation state of a gauge, e.g. after it was deleted
+func (gd *GaugeDecimator) Forget(g prometheus.Gauge) {
+	gd.mu.Lock()
+	defer gd.mu.Unlock()
+	delete(gd.gauges, g)
+}
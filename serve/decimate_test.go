@@ -0,0 +1,63 @@
+package serve_test
+
+import (
+	"signalfx-prometheus-exporter/serve"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingGauge struct {
+	prometheus.Gauge
+	sets int64
+}
+
+func (cg *countingGauge) Set(value float64) {
+	atomic.AddInt64(&cg.sets, 1)
+	cg.Gauge.Set(value)
+}
+
+func gaugeValue(g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	g.Write(m)
+	return m.GetGauge().GetValue()
+}
+
+func TestGaugeDecimatorKeepsLatest(t *testing.T) {
+	gd := serve.NewGaugeDecimator()
+	g := &countingGauge{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "some_gauge"})}
+
+	gd.Set(g, 1, 50*time.Millisecond)
+	gd.Set(g, 2, 50*time.Millisecond)
+	gd.Set(g, 3, 50*time.Millisecond)
+	assert.Equal(t, 1.0, gaugeValue(g))
+
+	assert.Eventually(t, func() bool {
+		return gaugeValue(g) == 3.0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&g.sets))
+}
+
+func TestGaugeDecimatorDisabled(t *testing.T) {
+	gd := serve.NewGaugeDecimator()
+	g := &countingGauge{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "some_gauge"})}
+
+	gd.Set(g, 1, 0)
+	gd.Set(g, 2, 0)
+	assert.Equal(t, 2.0, gaugeValue(g))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&g.sets))
+}
+
+func BenchmarkGaugeDecimator(b *testing.B) {
+	gd := serve.NewGaugeDecimator()
+	g := &countingGauge{Gauge: prometheus.NewGauge(prometheus.GaugeOpts{Name: "some_gauge"})}
+	for i := 0; i < b.N; i++ {
+		gd.Set(g, float64(i), time.Second)
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&g.sets)), "sets")
+	b.ReportMetric(float64(b.N), "updates")
+}
@@ -0,0 +1,130 @@
+package serve
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// bearer token guarding /-/dump, which is disabled without one
+var dumpToken string
+
+// SeriesDump is a single series of the registry as returned by /-/dump
+type SeriesDump struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	// nil for NaN and infinite values, which JSON can't represent
+	Value      *float64   `json:"value"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+}
+
+// DumpSeries gathers the scalar series of a gatherer, along with the time
+// flows last updated them according to lastUpdates
+func DumpSeries(gatherer prometheus.Gatherer, lastUpdates map[string]time.Time) ([]SeriesDump, error) {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	dumps := []SeriesDump{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			dump := SeriesDump{
+				Name:   mf.GetName(),
+				Type:   strings.ToLower(mf.GetType().String()),
+				Labels: make(map[string]string, len(m.GetLabel())),
+			}
+			if !math.IsNaN(value) && !math.IsInf(value, 0) {
+				dump.Value = &value
+			}
+			labelNames := make([]string, len(m.GetLabel()))
+			labelValues := make([]string, len(m.GetLabel()))
+			for i, l := range m.GetLabel() {
+				dump.Labels[l.GetName()] = l.GetValue()
+				labelNames[i] = l.GetName()
+				labelValues[i] = l.GetValue()
+			}
+			if lastUpdate, ok := lastUpdates[exposedSeriesKey(mf.GetName(), labelNames, labelValues)]; ok {
+				dump.LastUpdate = &lastUpdate
+			}
+			dumps = append(dumps, dump)
+		}
+	}
+	return dumps, nil
+}
+
+func dumpHandler(w http.ResponseWriter, r *http.Request) {
+	if dumpToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+dumpToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be one of json or csv", http.StatusBadRequest)
+		return
+	}
+
+	dumps, err := DumpSeries(sfxBaseGatherer, sfxSeries.exposedLastUpdates())
+	if err != nil {
+		Log().Errorf("failed to dump series: %+s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writeDumpCSV(w, dumps)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dumps)
+}
+
+// writeDumpCSV writes one row per series, with the labels in selector notation
+func writeDumpCSV(w http.ResponseWriter, dumps []SeriesDump) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "type", "labels", "value", "last_update"})
+	for _, d := range dumps {
+		pairs := make([]string, 0, len(d.Labels))
+		for k, v := range d.Labels {
+			pairs = append(pairs, k+"="+strconv.Quote(v))
+		}
+		sort.Strings(pairs)
+		value := ""
+		if d.Value != nil {
+			value = strconv.FormatFloat(*d.Value, 'g', -1, 64)
+		}
+		lastUpdate := ""
+		if d.LastUpdate != nil {
+			lastUpdate = d.LastUpdate.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{d.Name, d.Type, strings.Join(pairs, ","), value, lastUpdate})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,283 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	. "signalfx-prometheus-exporter/utils"
+)
+
+const (
+	flowQueued     = "queued"
+	flowConnecting = "connecting"
+	flowStreaming  = "streaming"
+	flowFailed     = "failed"
+	flowFinished   = "finished"
+	flowDisabled   = "disabled"
+	flowDead       = "dead"
+)
+
+var (
+	flowStates     = make(map[string]*flowState)
+	flowStatesLock sync.RWMutex
+)
+
+// flowState tracks the runtime state of a single flow
+type flowState struct {
+	mu          sync.RWMutex
+	name        string
+	secret      string
+	state       string
+	lastError   string
+	lastPayload time.Time
+	reconnects  int
+	resolution  time.Duration
+	maxDelay    time.Duration
+	staleAfter  time.Duration
+	maxFailures int
+	failures    int
+	resume      chan struct{}
+}
+
+// FlowStatus is the json representation of a flows runtime state
+type FlowStatus struct {
+	Flow        string     `json:"flow"`
+	State       string     `json:"state"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastPayload *time.Time `json:"lastPayload,omitempty"`
+	Reconnects  int        `json:"reconnects"`
+	Series      int        `json:"series"`
+	MaxDelay    string     `json:"maxDelay,omitempty"`
+	StaleAfter  string     `json:"staleAfter,omitempty"`
+	Stale       bool       `json:"stale"`
+}
+
+func newFlowState(name string, secret string, staleAfter time.Duration, maxFailures int) *flowState {
+	fs := &flowState{name: name, secret: secret, state: flowConnecting, staleAfter: staleAfter, maxFailures: maxFailures}
+	flowStatesLock.Lock()
+	defer flowStatesLock.Unlock()
+	flowStates[name] = fs
+	return fs
+}
+
+func removeFlowState(name string) {
+	flowStatesLock.Lock()
+	defer flowStatesLock.Unlock()
+	delete(flowStates, name)
+}
+
+func getFlowState(name string) (*flowState, bool) {
+	flowStatesLock.RLock()
+	defer flowStatesLock.RUnlock()
+	fs, ok := flowStates[name]
+	return fs, ok
+}
+
+// unreadyFlows lists the flows without an active computation that delivered
+// data. finished flows stay ready as long as they received data before.
+func unreadyFlows() []string {
+	flowStatesLock.RLock()
+	defer flowStatesLock.RUnlock()
+	unready := []string{}
+	for name, fs := range flowStates {
+		if !fs.ready() {
+			unready = append(unready, name)
+		}
+	}
+	sort.Strings(unready)
+	return unready
+}
+
+func (fs *flowState) ready() bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if fs.lastPayload.IsZero() {
+		return false
+	}
+	return fs.state == flowStreaming || fs.state == flowFinished
+}
+
+// reconnecting records a dropped stream that is about to be established again
+func (fs *flowState) reconnecting(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state = flowConnecting
+	fs.lastError = fs.redact(err)
+	fs.reconnects++
+}
+
+func (fs *flowState) currentState() string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.state
+}
+
+func (fs *flowState) setState(state string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state = state
+}
+
+func (fs *flowState) setError(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state = flowFailed
+	fs.lastError = fs.redact(err)
+}
+
+// redact never leaks the access token, even if it ends up in an error message
+func (fs *flowState) redact(err error) string {
+	if fs.secret == "" {
+		return err.Error()
+	}
+	return strings.ReplaceAll(err.Error(), fs.secret, "<redacted>")
+}
+
+// receivedSince tells whether a payload arrived after the given time
+func (fs *flowState) receivedSince(t time.Time) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.lastPayload.After(t)
+}
+
+func (fs *flowState) payloadReceived() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lastPayload = time.Now()
+}
+
+// payloadProcessed counts consecutive payload failures and opens the circuit
+// of the flow once maxFailures is reached. returns true if the circuit is open.
+func (fs *flowState) payloadProcessed(failed bool) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !failed {
+		fs.failures = 0
+		return false
+	}
+	fs.failures++
+	if fs.maxFailures == 0 || fs.failures < fs.maxFailures {
+		return false
+	}
+	fs.state = flowDisabled
+	fs.lastError = fmt.Sprintf("circuit opened after %d consecutive failures", fs.failures)
+	fs.resume = make(chan struct{})
+	flowCircuitOpen.WithLabelValues(fs.name).Set(1)
+	return true
+}
+
+// resumeFlow closes the circuit of a disabled flow, returns false if it wasn't open
+func (fs *flowState) resumeFlow() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.state != flowDisabled {
+		return false
+	}
+	fs.state = flowConnecting
+	fs.failures = 0
+	close(fs.resume)
+	flowCircuitOpen.WithLabelValues(fs.name).Set(0)
+	return true
+}
+
+// waitForResume blocks until the flow is resumed or the context is done
+func (fs *flowState) waitForResume(ctx context.Context) bool {
+	fs.mu.RLock()
+	resume := fs.resume
+	fs.mu.RUnlock()
+	select {
+	case <-resume:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// setJobTiming records the resolution and max delay SignalFlow reported for the job
+func (fs *flowState) setJobTiming(resolution time.Duration, maxDelay time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.resolution = resolution
+	fs.maxDelay = maxDelay
+}
+
+// stalenessThreshold is the time after which a flow without payloads is
+// considered stale. unless configured explicitly, data is expected once per
+// resolution but can arrive as late as the max delay of the job. 0 means the
+// threshold is not known yet.
+func (fs *flowState) stalenessThreshold() time.Duration {
+	if fs.staleAfter > 0 {
+		return fs.staleAfter
+	}
+	if fs.maxDelay == 0 && fs.resolution == 0 {
+		return 0
+	}
+	return fs.resolution + fs.maxDelay
+}
+
+func (fs *flowState) isStale() bool {
+	threshold := fs.stalenessThreshold()
+	if threshold == 0 || fs.state != flowStreaming {
+		return false
+	}
+	if fs.lastPayload.IsZero() {
+		return false
+	}
+	return time.Since(fs.lastPayload) > threshold
+}
+
+func (fs *flowState) status() FlowStatus {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	status := FlowStatus{
+		Flow:       fs.name,
+		State:      fs.state,
+		LastError:  fs.lastError,
+		Reconnects: fs.reconnects,
+		Series:     sfxSeries.countForFlow(fs.name),
+		Stale:      fs.isStale(),
+	}
+	if fs.maxDelay > 0 {
+		status.MaxDelay = fs.maxDelay.String()
+	}
+	if threshold := fs.stalenessThreshold(); threshold > 0 {
+		status.StaleAfter = threshold.String()
+	}
+	if !fs.lastPayload.IsZero() {
+		lastPayload := fs.lastPayload
+		status.LastPayload = &lastPayload
+	}
+	return status
+}
+
+func flowStatusHandler(w http.ResponseWriter, r *http.Request) {
+	fs, ok := getFlowState(mux.Vars(r)["name"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fs.status())
+}
+
+func flowResumeHandler(w http.ResponseWriter, r *http.Request) {
+	fs, ok := getFlowState(mux.Vars(r)["name"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !fs.resumeFlow() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	Log().Infof("Flow %s resumed", fs.name)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,130 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	graphiteUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_:-]`)
+	graphiteDialTimeout = 10 * time.Second
+
+	// graphite push observability
+	graphitePushesFailed   prometheus.Counter
+	graphiteMetricsWritten prometheus.Counter
+)
+
+func graphiteComponent(s string) string {
+	return graphiteUnsafeChars.ReplaceAllString(s, "_")
+}
+
+// graphitePath builds the dot-joined graphite path of a metric from its name
+// and labels. The pairs scheme yields name.label.value, the values scheme only
+// name.value, both with labels ordered by label name.
+func graphitePath(prefix string, scheme string, name string, labels []*dto.LabelPair) string {
+	sorted := make([]*dto.LabelPair, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	components := []string{}
+	if prefix != "" {
+		components = append(components, prefix)
+	}
+	components = append(components, graphiteComponent(name))
+	for _, l := range sorted {
+		if scheme == "pairs" {
+			components = append(components, graphiteComponent(l.GetName()))
+		}
+		components = append(components, graphiteComponent(l.GetValue()))
+	}
+	return strings.Join(components, ".")
+}
+
+// WriteGraphite writes metric families in the graphite plaintext format
+func WriteGraphite(w io.Writer, mfs []*dto.MetricFamily, prefix string, scheme string, ts time.Time) (int, error) {
+	written := 0
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			path := graphitePath(prefix, scheme, mf.GetName(), m.GetLabel())
+			if _, err := fmt.Fprintf(w, "%s %g %d\n", path, value, ts.Unix()); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+	return written, nil
+}
+
+func pushGraphite(cfg config.Graphite, gatherer prometheus.Gatherer) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", cfg.Address, graphiteDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	written, err := WriteGraphite(w, mfs, cfg.Prefix, cfg.LabelScheme, time.Now())
+	if err != nil {
+		return err
+	}
+	graphiteMetricsWritten.Add(float64(written))
+	return w.Flush()
+}
+
+func setupGraphite(cfg config.Graphite, ctx context.Context) {
+	graphitePushesFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_graphite_pushes_failed_total",
+		Help: "Number of failed pushes to graphite",
+	})
+	graphiteMetricsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_graphite_metrics_written_total",
+		Help: "Number of metrics written to graphite",
+	})
+	prometheus.MustRegister(graphitePushesFailed)
+	prometheus.MustRegister(graphiteMetricsWritten)
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := pushGraphite(cfg, sfxBaseGatherer); err != nil {
+					graphitePushesFailed.Inc()
+					Log().Errorf("graphite push to %s failed: %+s", cfg.Address, err)
+				}
+			}
+		}
+	}()
+	Log().Infof("Pushing metrics to graphite at %s every %v", cfg.Address, cfg.Interval)
+}
@@ -0,0 +1,43 @@
+package serve_test
+
+import (
+	"bytes"
+	"signalfx-prometheus-exporter/serve"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func gatherGraphiteFixture(t *testing.T) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "some_gauge"},
+		[]string{"instance", "env"},
+	)
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("host.example.com", "prod").Set(1.5)
+	return registry
+}
+
+func TestWriteGraphitePairs(t *testing.T) {
+	mfs, err := gatherGraphiteFixture(t).Gather()
+	assert.Nil(t, err)
+
+	var buffer bytes.Buffer
+	written, err := serve.WriteGraphite(&buffer, mfs, "sfx", "pairs", time.Unix(1000, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, written)
+	assert.Equal(t, "sfx.some_gauge.env.prod.instance.host_example_com 1.5 1000\n", buffer.String())
+}
+
+func TestWriteGraphiteValues(t *testing.T) {
+	mfs, err := gatherGraphiteFixture(t).Gather()
+	assert.Nil(t, err)
+
+	var buffer bytes.Buffer
+	_, err = serve.WriteGraphite(&buffer, mfs, "", "values", time.Unix(1000, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, "some_gauge.prod.host_example_com 1.5 1000\n", buffer.String())
+}
@@ -0,0 +1,139 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+
+	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/segmentio/kafka-go"
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+)
+
+var (
+	kafkaSink *KafkaSink
+
+	// kafka sink observability
+	kafkaRecordsWritten prometheus.Counter
+	kafkaRecordsFailed  prometheus.Counter
+)
+
+// KafkaRecord is a processed SignalFX payload together with the Prometheus
+// metric it was translated into
+type KafkaRecord struct {
+	Flow      string            `json:"flow"`
+	Stream    string            `json:"stream"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// Encode serializes the record as json or as a Prometheus protobuf MetricFamily
+func (kr *KafkaRecord) Encode(serialization string) ([]byte, error) {
+	if serialization == "json" {
+		return json.Marshal(kr)
+	}
+
+	m := &dto.Metric{TimestampMs: proto.Int64(kr.Timestamp)}
+	for name, value := range kr.Labels {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	mf := &dto.MetricFamily{Name: proto.String(kr.Name), Metric: []*dto.Metric{m}}
+	if kr.Type == "counter" {
+		mf.Type = dto.MetricType_COUNTER.Enum()
+		m.Counter = &dto.Counter{Value: proto.Float64(kr.Value)}
+	} else {
+		mf.Type = dto.MetricType_GAUGE.Enum()
+		m.Gauge = &dto.Gauge{Value: proto.Float64(kr.Value)}
+	}
+	return proto.Marshal(mf)
+}
+
+// KafkaSink publishes processed payloads to a kafka topic
+type KafkaSink struct {
+	writer        *kafka.Writer
+	serialization string
+}
+
+func NewKafkaSink(cfg config.Kafka) *KafkaSink {
+	return &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchSize:    cfg.BatchSize,
+			BatchTimeout: cfg.BatchTimeout,
+			Async:        true,
+			Completion: func(msgs []kafka.Message, err error) {
+				if err != nil {
+					kafkaRecordsFailed.Add(float64(len(msgs)))
+					Log().Errorf("failed to write %d records to kafka: %+s", len(msgs), err)
+				} else {
+					kafkaRecordsWritten.Add(float64(len(msgs)))
+				}
+			},
+		},
+		serialization: cfg.Serialization,
+	}
+}
+
+func (ks *KafkaSink) Publish(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties, value float64, timestampMs uint64) error {
+	name, labelNames, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return err
+	}
+	record := &KafkaRecord{
+		Flow:      fp.Name,
+		Stream:    metric.Stream,
+		Name:      name,
+		Type:      metric.Type,
+		Labels:    make(map[string]string, len(labelNames)),
+		Value:     value,
+		Timestamp: int64(timestampMs),
+	}
+	for i, labelName := range labelNames {
+		record.Labels[labelName] = labelValues[i]
+	}
+	payload, err := record.Encode(ks.serialization)
+	if err != nil {
+		return err
+	}
+	// series with the same key always end up in the same partition
+	return ks.writer.WriteMessages(context.Background(), kafka.Message{
+		Key:   []byte(seriesKey(name, labelValues)),
+		Value: payload,
+	})
+}
+
+func (ks *KafkaSink) Close() error {
+	return ks.writer.Close()
+}
+
+func setupKafka(cfg config.Kafka, ctx context.Context) {
+	kafkaRecordsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_kafka_records_written_total",
+		Help: "Number of records written to kafka",
+	})
+	kafkaRecordsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_kafka_records_failed_total",
+		Help: "Number of records that failed to be written to kafka",
+	})
+	prometheus.MustRegister(kafkaRecordsWritten)
+	prometheus.MustRegister(kafkaRecordsFailed)
+
+	kafkaSink = NewKafkaSink(cfg)
+	go func() {
+		<-ctx.Done()
+		if err := kafkaSink.Close(); err != nil {
+			Log().Errorf("failed to close kafka writer: %+s", err)
+		}
+	}()
+	Log().Infof("Publishing payloads to kafka topic %s", cfg.Topic)
+}
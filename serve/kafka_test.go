@@ -0,0 +1,43 @@
+package serve_test
+
+import (
+	"encoding/json"
+	"signalfx-prometheus-exporter/serve"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+var kafkaRecord = serve.KafkaRecord{
+	Flow:      "flow",
+	Stream:    "default",
+	Name:      "some_counter_total",
+	Type:      "counter",
+	Labels:    map[string]string{"instance": "foo"},
+	Value:     3,
+	Timestamp: 1000,
+}
+
+func TestKafkaRecordJSON(t *testing.T) {
+	payload, err := kafkaRecord.Encode("json")
+	assert.Nil(t, err)
+
+	var decoded serve.KafkaRecord
+	assert.Nil(t, json.Unmarshal(payload, &decoded))
+	assert.Equal(t, kafkaRecord, decoded)
+}
+
+func TestKafkaRecordProtobuf(t *testing.T) {
+	payload, err := kafkaRecord.Encode("protobuf")
+	assert.Nil(t, err)
+
+	var mf dto.MetricFamily
+	assert.Nil(t, proto.Unmarshal(payload, &mf))
+	assert.Equal(t, "some_counter_total", mf.GetName())
+	assert.Equal(t, dto.MetricType_COUNTER, mf.GetType())
+	assert.Equal(t, 3.0, mf.Metric[0].GetCounter().GetValue())
+	assert.Equal(t, int64(1000), mf.Metric[0].GetTimestampMs())
+	assert.Equal(t, "instance", mf.Metric[0].Label[0].GetName())
+}
@@ -0,0 +1,111 @@
+package serve
+
+import (
+	"signalfx-prometheus-exporter/config"
+	"sync"
+	"time"
+
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+)
+
+// labelCacheKey identifies the rendering of a time series. the same TSID can
+// show up in several streams of a flow, each rendered by a different template,
+// so the stream is part of the key.
+type labelCacheKey struct {
+	flow   string
+	tsid   idtool.ID
+	stream string
+}
+
+type labelCacheEntry struct {
+	meta        *messages.MetadataProperties
+	name        string
+	labelNames  []string
+	labelValues []string
+	// newer metadata held back by the metadataDebounce of the flow
+	pending      *messages.MetadataProperties
+	pendingSince time.Time
+}
+
+// labelCache keeps the rendered metric name and labels of time series, so
+// templates only need to be rendered again once the metadata of a TSID changes
+type labelCache struct {
+	mu      sync.Mutex
+	entries map[labelCacheKey]*labelCacheEntry
+}
+
+func newLabelCache() *labelCache {
+	return &labelCache{entries: make(map[labelCacheKey]*labelCacheEntry)}
+}
+
+func (lc *labelCache) render(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (string, []string, []string, error) {
+	key := labelCacheKey{flow: fp.Name, tsid: tsid, stream: metric.Stream}
+	lc.mu.Lock()
+	e, ok := lc.entries[key]
+	// the signalflow client replaces the metadata of a TSID on updates
+	current := ok && (e.meta == sfxMeta || lc.debounced(fp, e, sfxMeta))
+	lc.mu.Unlock()
+	if current {
+		return e.name, e.labelNames, e.labelValues, nil
+	}
+
+	name, labelNames, labelValues, err := buildPrometheusMetadata(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.entries[key] = &labelCacheEntry{meta: sfxMeta, name: name, labelNames: labelNames, labelValues: labelValues}
+	return name, labelNames, labelValues, nil
+}
+
+// debounced tells whether updated metadata of a TSID is held back, keeping the
+// previous rendering until the metadata didn't change for the metadataDebounce of
+// the flow. flapping metadata thereby doesn't relabel the series on every update.
+// the lock must be held.
+func (lc *labelCache) debounced(fp config.FlowProgram, e *labelCacheEntry, sfxMeta *messages.MetadataProperties) bool {
+	if fp.MetadataDebounce <= 0 {
+		return false
+	}
+	if e.pending != sfxMeta {
+		e.pending = sfxMeta
+		e.pendingSince = time.Now()
+		metadataDebounced.WithLabelValues(fp.Name).Inc()
+		return true
+	}
+	return time.Since(e.pendingSince) < fp.MetadataDebounce
+}
+
+func (lc *labelCache) removeFlow(flow string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for key := range lc.entries {
+		if key.flow == flow {
+			delete(lc.entries, key)
+		}
+	}
+}
+
+// removeSeries forgets the renderings of series that were reaped, so the TSIDs
+// of churning dimensions don't pile up. the names of counters only get their
+// _total suffix after rendering, so both names match.
+func (lc *labelCache) removeSeries(series []*trackedSeries) {
+	reaped := make(map[string]bool, len(series))
+	for _, s := range series {
+		reaped[s.flow+"\xff"+seriesKey(s.name, s.labelValues)] = true
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for key, e := range lc.entries {
+		if reaped[key.flow+"\xff"+seriesKey(e.name, e.labelValues)] || reaped[key.flow+"\xff"+seriesKey(e.name+"_total", e.labelValues)] {
+			delete(lc.entries, key)
+		}
+	}
+}
+
+func (lc *labelCache) clear() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.entries = make(map[labelCacheKey]*labelCacheEntry)
+}
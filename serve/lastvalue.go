@@ -0,0 +1,60 @@
+package serve
+
+import (
+	"sync"
+
+	"github.com/signalfx/signalfx-go/idtool"
+)
+
+// lastValueStore remembers the last value of every SignalFX time series
+// that writes to an exposed series. several time series can write to the same
+// exposed series, e.g. when a template drops the dimensions telling them apart,
+// so values are kept per series and TSID. the values of a series are deleted
+// along with the series.
+type lastValueStore struct {
+	mu     sync.Mutex
+	values map[string]map[idtool.ID]float64
+}
+
+func newLastValueStore() *lastValueStore {
+	return &lastValueStore{values: make(map[string]map[idtool.ID]float64)}
+}
+
+func (s *lastValueStore) get(series string, tsid idtool.ID) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[series][tsid]
+	return value, ok
+}
+
+func (s *lastValueStore) set(series string, tsid idtool.ID, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLocked(series, tsid, value)
+}
+
+// swap sets a new value and returns the previous one, in one step so
+// concurrent writers of a time series don't see the same previous value
+func (s *lastValueStore) swap(series string, tsid idtool.ID, value float64) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.values[series][tsid]
+	s.setLocked(series, tsid, value)
+	return last, ok
+}
+
+func (s *lastValueStore) setLocked(series string, tsid idtool.ID, value float64) {
+	values, ok := s.values[series]
+	if !ok {
+		values = make(map[idtool.ID]float64)
+		s.values[series] = values
+	}
+	values[tsid] = value
+}
+
+// delete forgets the values of all time series of a series
+func (s *lastValueStore) delete(series string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, series)
+}
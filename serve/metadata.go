@@ -0,0 +1,115 @@
+package serve
+
+import (
+	"sort"
+	"sync"
+
+	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+)
+
+var sfxMetadata = newMetadataCollector()
+
+func init() {
+	sfxRegistry.MustRegister(sfxMetadata)
+}
+
+// metadataCollector exposes the SignalFX metadata of series as companion
+// <metric>_meta series with the value 1. the label names of these series differ
+// from series to series, so the collector is unchecked and describes nothing.
+type metadataCollector struct {
+	mu     sync.RWMutex
+	series map[string]prometheus.Metric
+}
+
+func newMetadataCollector() *metadataCollector {
+	return &metadataCollector{series: make(map[string]prometheus.Metric)}
+}
+
+func (mc *metadataCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (mc *metadataCollector) Collect(ch chan<- prometheus.Metric) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	for _, m := range mc.series {
+		ch <- m
+	}
+}
+
+// set records the metadata series of a value series, unless it is known already
+func (mc *metadataCollector) set(name string, labelNames []string, labelValues []string, dimensions map[string]string) error {
+	key := seriesKey(name, labelValues)
+	mc.mu.RLock()
+	_, ok := mc.series[key]
+	mc.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	// the labels of the value series take precedence over dimensions. dimensions
+	// that sanitize to the same label name are taken in order, the first one wins
+	labels := make(prometheus.Labels, len(dimensions)+len(labelNames))
+	dimensionNames := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		dimensionNames = append(dimensionNames, k)
+	}
+	sort.Strings(dimensionNames)
+	sanitizedFrom := make(map[string]string, len(dimensions))
+	for _, k := range dimensionNames {
+		label := SanitizeLabelName(k)
+		if first, ok := sanitizedFrom[label]; ok {
+			Log().Debugf("dimensions %s and %s of metric %s both become label %s, keeping %s", first, k, name, label, first)
+			continue
+		}
+		sanitizedFrom[label] = k
+		labels[label] = dimensions[k]
+	}
+	for i, k := range labelNames {
+		labels[k] = labelValues[i]
+	}
+	desc := prometheus.NewDesc(name+"_meta", "SignalFX metadata of "+name, nil, labels)
+	m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1)
+	if err != nil {
+		return err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.series[key] = m
+	return nil
+}
+
+func (mc *metadataCollector) delete(name string, labelValues []string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.series, seriesKey(name, labelValues))
+}
+
+// metadataDimensions returns the dimensions of a series for its metadata series.
+//
+// dimensions are not known upfront, so target labels like job can't be rejected
+// at load time. unless reserved labels are kept, they are prefixed instead.
+func metadataDimensions(fp config.FlowProgram, sfxMeta *messages.MetadataProperties) map[string]string {
+	dimensions := coerceCustomProperties(sfxMeta.CustomProperties)
+	if fp.ReservedLabels == config.ReservedLabelsKeep {
+		return dimensions
+	}
+	renamed := make(map[string]string, len(dimensions))
+	for k, v := range dimensions {
+		if fp.ReservedLabelName(k) == k {
+			renamed[k] = v
+		}
+	}
+	// prefixed dimensions don't override dimensions that carry the prefix already
+	for k, v := range dimensions {
+		if prefixed := fp.ReservedLabelName(k); prefixed != k {
+			if _, ok := renamed[prefixed]; !ok {
+				renamed[prefixed] = v
+			}
+		}
+	}
+	return renamed
+}
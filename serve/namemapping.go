@@ -0,0 +1,59 @@
+package serve
+
+import (
+	"context"
+	"sync"
+
+	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+)
+
+var sfxNameMapping = &nameMapping{}
+
+// nameMapping holds the Prometheus metric names of SignalFX metrics, which take
+// precedence over the name templates of flows
+type nameMapping struct {
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+func (nm *nameMapping) lookup(sfxMetricName string) (string, bool) {
+	if sfxMetricName == "" {
+		return "", false
+	}
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+	name, ok := nm.names[sfxMetricName]
+	return name, ok
+}
+
+func (nm *nameMapping) replace(names map[string]string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.names = names
+}
+
+// setupNameMapping loads the name mapping file and reloads it on changes.
+//
+// a mapping file that fails to load on reload leaves the previous mapping in
+// place. the label cache is dropped on reloads, so series pick up their new
+// names with their next payload.
+func setupNameMapping(file string, ctx context.Context) error {
+	names, err := config.LoadNameMapping(file)
+	if err != nil {
+		return err
+	}
+	sfxNameMapping.replace(names)
+	Log().Infof("Loaded %d metric names from %s", len(names), file)
+
+	return WatchConfig(ctx, file, func() {
+		names, err := config.LoadNameMapping(file)
+		if err != nil {
+			Log().Errorf("failed to reload name mapping, keeping the previous one: %+s", err)
+			return
+		}
+		sfxNameMapping.replace(names)
+		sfxLabels.clear()
+		Log().Infof("Reloaded %d metric names from %s", len(names), file)
+	})
+}
@@ -0,0 +1,52 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	. "signalfx-prometheus-exporter/utils"
+)
+
+const probeLimitQuietPeriod = 10 * time.Second
+
+// limits concurrent probe scrapes, nil when unlimited
+var probeLimit *probeLimiter
+
+// probeLimiter is a semaphore for probe scrapes that rejects instead of queueing
+type probeLimiter struct {
+	slots        chan struct{}
+	mu           sync.Mutex
+	lastRejected time.Time
+}
+
+func newProbeLimiter(limit int) *probeLimiter {
+	return &probeLimiter{slots: make(chan struct{}, limit)}
+}
+
+// acquire takes a slot if one is free, callers that got one must release it
+func (pl *probeLimiter) acquire() bool {
+	select {
+	case pl.slots <- struct{}{}:
+	default:
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
+		if pl.lastRejected.IsZero() {
+			Log().Warnf("Probe concurrency limit of %d engaged, rejecting probes", cap(pl.slots))
+		}
+		pl.lastRejected = time.Now()
+		probesRejected.Inc()
+		return false
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if !pl.lastRejected.IsZero() && time.Since(pl.lastRejected) > probeLimitQuietPeriod {
+		Log().Infof("Probe concurrency limit disengaged")
+		pl.lastRejected = time.Time{}
+	}
+	return true
+}
+
+func (pl *probeLimiter) release() {
+	<-pl.slots
+}
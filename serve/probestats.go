@@ -0,0 +1,54 @@
+package serve
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// countingResponseWriter counts the bytes written to a response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.written += n
+	return n, err
+}
+
+// allocMeasuringGatherer measures the heap allocated while gathering.
+//
+// the runtime only counts allocations of the whole process, so allocations of
+// concurrent scrapes and flows are included. it is an approximation of the
+// memory a gather needs, which is most accurate for scrapes that don't overlap.
+type allocMeasuringGatherer struct {
+	Gatherer  prometheus.Gatherer
+	Allocated uint64
+}
+
+func (amg *allocMeasuringGatherer) Gather() ([]*dto.MetricFamily, error) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	mfs, err := amg.Gatherer.Gather()
+	runtime.ReadMemStats(&after)
+	amg.Allocated = after.TotalAlloc - before.TotalAlloc
+	return mfs, err
+}
+
+// timingGatherer passes the time every gather took to Observe
+type timingGatherer struct {
+	Gatherer prometheus.Gatherer
+	Observe  func(time.Duration)
+}
+
+func (tg *timingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	start := time.Now()
+	mfs, err := tg.Gatherer.Gather()
+	tg.Observe(time.Since(start))
+	return mfs, err
+}
@@ -0,0 +1,70 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// how fmt formats large and small float64 values, which JSON numbers decode to
+var exponentNumber = regexp.MustCompile(`^-?[0-9](\.[0-9]+)?e[+-][0-9]+$`)
+
+// propertyString renders a decoded JSON property value as a label value
+func propertyString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		// lists and objects
+		if encoded, err := json.Marshal(value); err == nil {
+			return string(encoded)
+		}
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// coerceCustomProperties repairs custom properties that were not strings.
+//
+// the signalflow client formats custom property values with %v, which turns
+// null into "<nil>" and numbers like 1000000 into "1e+06". these are rendered
+// like propertyString would have. the original map is returned as is when
+// nothing needs to be repaired.
+func coerceCustomProperties(properties map[string]string) map[string]string {
+	var coerced map[string]string
+	for k, v := range properties {
+		repaired, ok := repairProperty(v)
+		if !ok {
+			continue
+		}
+		if coerced == nil {
+			coerced = make(map[string]string, len(properties))
+			for k, v := range properties {
+				coerced[k] = v
+			}
+		}
+		coerced[k] = repaired
+	}
+	if coerced == nil {
+		return properties
+	}
+	return coerced
+}
+
+func repairProperty(v string) (string, bool) {
+	if v == "<nil>" {
+		return "", true
+	}
+	if exponentNumber.MatchString(v) {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return propertyString(f), true
+		}
+	}
+	return "", false
+}
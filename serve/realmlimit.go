@@ -0,0 +1,72 @@
+package serve
+
+import (
+	"context"
+	"sync"
+
+	. "signalfx-prometheus-exporter/utils"
+)
+
+var (
+	// limits the running SignalFlow programs per realm, set up before flows start
+	realmLimiters     = make(map[string]*realmLimiter)
+	realmLimitersLock sync.RWMutex
+)
+
+// setRealmLimiters adds the limiters of realms without one. running flows hold
+// the slots of existing limiters, so a changed limit only applies on restart.
+func setRealmLimiters(limits map[string]int) {
+	realmLimitersLock.Lock()
+	defer realmLimitersLock.Unlock()
+	for realm, limit := range limits {
+		if limiter, ok := realmLimiters[realm]; ok {
+			if cap(limiter.slots) != limit {
+				Log().Warnf("maxConcurrentPrograms of realm %s changed from %d to %d, which applies on restart", realm, cap(limiter.slots), limit)
+			}
+			continue
+		}
+		realmLimiters[realm] = newRealmLimiter(realm, limit)
+		realmFlowsQueued.WithLabelValues(realm)
+	}
+}
+
+func getRealmLimiter(realm string) *realmLimiter {
+	realmLimitersLock.RLock()
+	defer realmLimitersLock.RUnlock()
+	return realmLimiters[realm]
+}
+
+// realmLimiter is a semaphore for the SignalFlow programs running against a realm
+type realmLimiter struct {
+	realm string
+	slots chan struct{}
+}
+
+func newRealmLimiter(realm string, limit int) *realmLimiter {
+	return &realmLimiter{realm: realm, slots: make(chan struct{}, limit)}
+}
+
+func (rl *realmLimiter) tryAcquire() bool {
+	select {
+	case rl.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait queues for a slot until one is free or the context is done
+func (rl *realmLimiter) wait(ctx context.Context) bool {
+	realmFlowsQueued.WithLabelValues(rl.realm).Inc()
+	defer realmFlowsQueued.WithLabelValues(rl.realm).Dec()
+	select {
+	case rl.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (rl *realmLimiter) release() {
+	<-rl.slots
+}
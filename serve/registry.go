@@ -2,8 +2,14 @@ package serve
 
 import (
 	"fmt"
+	"regexp"
 	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
@@ -12,6 +18,20 @@ type FilteringRegistry struct {
 	Registry    prometheus.Gatherer
 	Grouping    config.Grouping
 	FilterValue string
+	// only series matching any of the selectors are exposed, all without any
+	Selectors []VectorSelector
+}
+
+func (fr *FilteringRegistry) selected(name string, m *dto.Metric) bool {
+	if len(fr.Selectors) == 0 {
+		return true
+	}
+	for _, vs := range fr.Selectors {
+		if vs.Matches(name, m) {
+			return true
+		}
+	}
+	return false
 }
 
 func (fr *FilteringRegistry) Gather() ([]*dto.MetricFamily, error) {
@@ -27,8 +47,11 @@ func (fr *FilteringRegistry) Gather() ([]*dto.MetricFamily, error) {
 		for _, m := range mf.GetMetric() {
 			for _, l := range m.GetLabel() {
 				if *l.Name == fr.Grouping.Label && *l.Value == fr.FilterValue {
-					metrics = append(metrics, m)
+					// the ready condition applies to the whole group
 					metricCount++
+					if fr.selected(mf.GetName(), m) {
+						metrics = append(metrics, m)
+					}
 					break
 				}
 			}
@@ -49,3 +72,256 @@ func (fr *FilteringRegistry) Gather() ([]*dto.MetricFamily, error) {
 		return nil, fmt.Errorf("Not enough metrics in group. minMetrics = %d", fr.Grouping.GroupReadyCondition.MinMetrics)
 	}
 }
+
+// LabelCompactingGatherer drops labels with empty values from all metrics of
+// the families selected by Compact. Prometheus treats an empty label value
+// like a missing label, so this never changes the identity of a series.
+type LabelCompactingGatherer struct {
+	Gatherer prometheus.Gatherer
+	Compact  func(name string) bool
+}
+
+func (lcg *LabelCompactingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	// registries return whatever they could gather alongside errors
+	mfs, err := lcg.Gatherer.Gather()
+
+	compactedMfs := make([]*dto.MetricFamily, len(mfs))
+	for i, mf := range mfs {
+		if !lcg.Compact(mf.GetName()) {
+			compactedMfs[i] = mf
+			continue
+		}
+		metrics := make([]*dto.Metric, len(mf.GetMetric()))
+		for j, m := range mf.GetMetric() {
+			labels := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				if l.GetValue() != "" {
+					labels = append(labels, l)
+				}
+			}
+			compacted := *m
+			compacted.Label = labels
+			metrics[j] = &compacted
+		}
+		compactedMfs[i] = &dto.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Metric: metrics,
+		}
+	}
+	return compactedMfs, err
+}
+
+// LabelOrderingGatherer emits the labels of every metric in a stable order.
+// Labels listed in Order come first in that order, all others follow sorted
+// by name.
+type LabelOrderingGatherer struct {
+	Gatherer prometheus.Gatherer
+	Order    []string
+}
+
+func (lg *LabelOrderingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := lg.Gatherer.Gather()
+
+	rank := make(map[string]int, len(lg.Order))
+	for i, name := range lg.Order {
+		rank[name] = i - len(lg.Order)
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make([]*dto.LabelPair, len(m.GetLabel()))
+			copy(labels, m.GetLabel())
+			sort.SliceStable(labels, func(i, j int) bool {
+				ri, rj := rank[labels[i].GetName()], rank[labels[j].GetName()]
+				if ri != rj {
+					return ri < rj
+				}
+				return labels[i].GetName() < labels[j].GetName()
+			})
+			m.Label = labels
+		}
+	}
+	return mfs, err
+}
+
+// MetricFilteringGatherer only keeps the metrics accepted by Filter and drops
+// metric families that end up empty
+type MetricFilteringGatherer struct {
+	Gatherer prometheus.Gatherer
+	Filter   func(name string, m *dto.Metric) bool
+}
+
+func (mfg *MetricFilteringGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := mfg.Gatherer.Gather()
+
+	filteredMfs := []*dto.MetricFamily{}
+	for _, mf := range mfs {
+		metrics := []*dto.Metric{}
+		for _, m := range mf.GetMetric() {
+			if mfg.Filter(mf.GetName(), m) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			filteredMfs = append(filteredMfs, &dto.MetricFamily{
+				Name:   mf.Name,
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Metric: metrics,
+			})
+		}
+	}
+	return filteredMfs, err
+}
+
+// StaleSeriesGatherer hides the series Stale reports at the time of the gather.
+// The series stay in the wrapped gatherer until they are reaped.
+type StaleSeriesGatherer struct {
+	Gatherer prometheus.Gatherer
+	Stale    func(now time.Time) map[string]bool
+}
+
+func (ssg *StaleSeriesGatherer) Gather() ([]*dto.MetricFamily, error) {
+	stale := ssg.Stale(time.Now())
+	if len(stale) == 0 {
+		return ssg.Gatherer.Gather()
+	}
+	filtering := &MetricFilteringGatherer{
+		Gatherer: ssg.Gatherer,
+		Filter: func(name string, m *dto.Metric) bool {
+			return !stale[gatheredSeriesKey(name, m)]
+		},
+	}
+	return filtering.Gather()
+}
+
+var gatherErrorFamily = regexp.MustCompile(`(?:collected metric |fqName: )"?([a-zA-Z_:][a-zA-Z0-9_:]*)`)
+
+// ErrorCountingGatherer logs the errors of every gather and counts them by the
+// metric family they occurred on. The family is "unknown" for errors that
+// don't name one.
+type ErrorCountingGatherer struct {
+	Gatherer prometheus.Gatherer
+	Errors   *prometheus.CounterVec
+}
+
+func (ecg *ErrorCountingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := ecg.Gatherer.Gather()
+	if err == nil {
+		return mfs, nil
+	}
+
+	errs, ok := err.(prometheus.MultiError)
+	if !ok {
+		errs = prometheus.MultiError{err}
+	}
+	for _, e := range errs {
+		family := "unknown"
+		if match := gatherErrorFamily.FindStringSubmatch(e.Error()); match != nil {
+			family = match[1]
+		}
+		ecg.Errors.WithLabelValues(family).Inc()
+		Log().Errorf("failed to gather metric family %s: %+s", family, e)
+	}
+	return mfs, err
+}
+
+// DerivedMetricsGatherer appends the derived metrics computed from the gathered
+// metrics. Groups of series that lack a metric of the expression, or whose
+// expression fails, e.g. by dividing by zero, produce no series.
+type DerivedMetricsGatherer struct {
+	Gatherer prometheus.Gatherer
+	Metrics  []config.DerivedMetric
+}
+
+func (dmg *DerivedMetricsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := dmg.Gatherer.Gather()
+
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	errs := prometheus.MultiError{}
+	if multiErr, ok := err.(prometheus.MultiError); ok {
+		errs = append(errs, multiErr...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	for _, dm := range dmg.Metrics {
+		if _, ok := families[dm.Name]; ok {
+			errs = append(errs, fmt.Errorf("derived metric %s collides with an exposed metric", dm.Name))
+			continue
+		}
+		mf := deriveMetric(dm, families)
+		if len(mf.GetMetric()) > 0 {
+			mfs = append(mfs, mf)
+		}
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, errs.MaybeUnwrap()
+}
+
+func deriveMetric(dm config.DerivedMetric, families map[string]*dto.MetricFamily) *dto.MetricFamily {
+	// sum the series of every referenced metric by the values of the On labels
+	groups := map[string]*config.DerivedMetricVars{}
+	groupKeys := []string{}
+	for _, name := range dm.Metrics() {
+		for _, m := range families[name].GetMetric() {
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			labels := make(map[string]string, len(dm.On))
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			groupLabels := make(map[string]string, len(dm.On))
+			keyParts := make([]string, len(dm.On))
+			for i, on := range dm.On {
+				groupLabels[on] = labels[on]
+				keyParts[i] = labels[on]
+			}
+			key := strings.Join(keyParts, "\xff")
+			group, ok := groups[key]
+			if !ok {
+				group = &config.DerivedMetricVars{Labels: groupLabels, Values: map[string]float64{}}
+				groups[key] = group
+				groupKeys = append(groupKeys, key)
+			}
+			group.Values[name] += value
+		}
+	}
+
+	metrics := []*dto.Metric{}
+	sort.Strings(groupKeys)
+	for _, key := range groupKeys {
+		group := groups[key]
+		value, err := dm.Evaluate(*group)
+		if err != nil {
+			continue
+		}
+		labels := []*dto.LabelPair{}
+		for _, on := range dm.On {
+			// empty labels are the same as missing ones
+			if group.Labels[on] != "" {
+				labels = append(labels, &dto.LabelPair{Name: proto.String(on), Value: proto.String(group.Labels[on])})
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+		metrics = append(metrics, &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(value)}})
+	}
+	return &dto.MetricFamily{
+		Name:   proto.String(dm.Name),
+		Help:   proto.String(dm.Help),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: metrics,
+	}
+}
@@ -1,11 +1,14 @@
 package serve_test
 
 import (
+	"errors"
 	"signalfx-prometheus-exporter/config"
 	"signalfx-prometheus-exporter/serve"
+	"strings"
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -120,3 +123,212 @@ func TestTooFewSupplied(t *testing.T) {
 	_, err := fr.Gather()
 	assert.Error(t, err)
 }
+
+func TestFilterGroupSelectors(t *testing.T) {
+	fr, registry := setupRegistry(0)
+	requests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "requests_total"},
+		[]string{FilterLabel, "code"},
+	)
+	latency := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "latency_seconds"},
+		[]string{FilterLabel, "code"},
+	)
+	ratio := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "errors_ratio"},
+		[]string{FilterLabel},
+	)
+	registry.MustRegister(requests, latency, ratio)
+	requests.WithLabelValues(FilterValue, "200").Add(1)
+	requests.WithLabelValues(FilterValue, "500").Add(1)
+	latency.WithLabelValues(FilterValue, "200").Set(1)
+	latency.WithLabelValues(FilterValue, "500").Set(1)
+	ratio.WithLabelValues(FilterValue).Set(1)
+	requests.WithLabelValues("other_value", "500").Add(1)
+
+	selected := func(selectors ...string) []string {
+		fr.Selectors = nil
+		for _, selector := range selectors {
+			vs, err := serve.ParseVectorSelector(selector)
+			assert.Nil(t, err)
+			fr.Selectors = append(fr.Selectors, vs)
+		}
+		mfs, err := fr.Gather()
+		assert.Nil(t, err)
+		series := []string{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				series = append(series, mf.GetName()+"/"+m.GetLabel()[0].GetValue())
+			}
+		}
+		return series
+	}
+
+	assert.Len(t, selected(), 5)
+	assert.Equal(t, []string{"requests_total/200", "requests_total/500"}, selected("requests_total"))
+	assert.ElementsMatch(t, []string{"requests_total/500", "errors_ratio/value", "latency_seconds/200"},
+		selected(`requests_total{code="500"}`, `{__name__="errors_ratio"}`, `latency_seconds{code="200",label="value"}`))
+	assert.ElementsMatch(t, []string{"requests_total/500", "latency_seconds/500"},
+		selected(`{__name__=~".+_(total|seconds)",code=~"5..",code!="200"}`))
+	assert.ElementsMatch(t, []string{"latency_seconds/200", "latency_seconds/500", "errors_ratio/value"},
+		selected(`{__name__!~"requests_.*"}`))
+}
+
+func TestParseVectorSelector(t *testing.T) {
+	vs, err := serve.ParseVectorSelector(` requests_total { code = "5\"00", job!="api", } `)
+	assert.Nil(t, err)
+	assert.Equal(t, "requests_total", vs.Name)
+	assert.Len(t, vs.Matchers, 2)
+	assert.Equal(t, serve.LabelMatcher{Name: "code", Type: serve.MatchEqual, Value: `5"00`}, vs.Matchers[0])
+	assert.Equal(t, serve.LabelMatcher{Name: "job", Type: serve.MatchNotEqual, Value: "api"}, vs.Matchers[1])
+
+	vs, err = serve.ParseVectorSelector(`{__name__=~"requests_.*",code!~"5.."}`)
+	assert.Nil(t, err)
+	assert.Equal(t, serve.MatchRegexp, vs.Matchers[0].Type)
+	assert.Equal(t, serve.MatchNotRegexp, vs.Matchers[1].Type)
+	// regular expressions match the whole value
+	assert.True(t, vs.Matchers[0].Matches("requests_total"))
+	assert.False(t, vs.Matchers[0].Matches("http_requests_total"))
+	assert.False(t, vs.Matchers[1].Matches("500"))
+	assert.True(t, vs.Matchers[1].Matches("5000"))
+	assert.True(t, vs.Matchers[1].Matches(""))
+
+	for _, invalid := range []string{
+		"",
+		"{}",
+		"requests_total{",
+		`requests_total{code}`,
+		`requests_total{code=500}`,
+		`requests_total{code="500"`,
+		`requests_total{code="500"} extra`,
+		`requests_total{code="500" job="api"}`,
+		`requests_total{code=~"5(0"}`,
+		`requests_total{code~"500"}`,
+	} {
+		_, err := serve.ParseVectorSelector(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLabelCompactingGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	compacted := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "compacted_gauge"},
+		[]string{"host", "region"},
+	)
+	untouched := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "untouched_gauge"},
+		[]string{"host", "region"},
+	)
+	registry.MustRegister(compacted, untouched)
+	compacted.WithLabelValues("a", "").Set(1)
+	compacted.WithLabelValues("b", "eu").Set(2)
+	untouched.WithLabelValues("a", "").Set(3)
+
+	lcg := &serve.LabelCompactingGatherer{
+		Gatherer: registry,
+		Compact:  func(name string) bool { return name == "compacted_gauge" },
+	}
+	mfs, err := lcg.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, mfs, 2)
+
+	labelCounts := map[string][]int{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labelCounts[mf.GetName()] = append(labelCounts[mf.GetName()], len(m.GetLabel()))
+		}
+	}
+	assert.Equal(t, []int{1, 2}, labelCounts["compacted_gauge"])
+	assert.Equal(t, []int{2}, labelCounts["untouched_gauge"])
+
+	// the wrapped registry is left untouched
+	mfs, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, mfs[0].GetMetric()[0].GetLabel(), 2)
+}
+
+type brokenCollector struct {
+	desc *prometheus.Desc
+}
+
+func (bc brokenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bc.desc
+}
+
+func (bc brokenCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.NewInvalidMetric(bc.desc, errors.New("boom"))
+}
+
+func TestErrorCountingGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(brokenCollector{desc: prometheus.NewDesc("broken_gauge", "help", nil, nil)})
+	working := prometheus.NewGauge(prometheus.GaugeOpts{Name: "working_gauge"})
+	registry.MustRegister(working)
+
+	errorCounter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors_total"}, []string{"family"})
+	ecg := &serve.ErrorCountingGatherer{Gatherer: registry, Errors: errorCounter}
+
+	mfs, err := ecg.Gather()
+	assert.NotNil(t, err)
+	assert.Len(t, mfs, 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(errorCounter.WithLabelValues("broken_gauge")))
+}
+
+func TestLabelOrderingGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "ordered_gauge"},
+		[]string{"b", "flow", "a", "c"},
+	)
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("1", "2", "3", "4").Set(1)
+
+	labelNames := func(g prometheus.Gatherer) []string {
+		mfs, err := g.Gather()
+		assert.Nil(t, err)
+		names := []string{}
+		for _, l := range mfs[0].GetMetric()[0].GetLabel() {
+			names = append(names, l.GetName())
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"a", "b", "c", "flow"}, labelNames(&serve.LabelOrderingGatherer{Gatherer: registry}))
+	assert.Equal(t, []string{"flow", "c", "a", "b"}, labelNames(&serve.LabelOrderingGatherer{Gatherer: registry, Order: []string{"flow", "c", "unknown"}}))
+}
+
+func TestDerivedMetricsGatherer(t *testing.T) {
+	cfg, err := config.LoadConfigFromBytes([]byte(`
+sfx:
+  token: xxx
+derivedMetrics:
+- name: error_ratio
+  expression: '{{ div (.Metric "errors_total") (.Metric "requests_total") }}'
+  on: [service]
+`))
+	assert.Nil(t, err)
+
+	registry := prometheus.NewRegistry()
+	errorsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors_total"}, []string{"service", "host"})
+	requestsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"service", "host"})
+	registry.MustRegister(errorsTotal, requestsTotal)
+	errorsTotal.WithLabelValues("api", "a").Add(1)
+	errorsTotal.WithLabelValues("api", "b").Add(2)
+	requestsTotal.WithLabelValues("api", "a").Add(10)
+	requestsTotal.WithLabelValues("api", "b").Add(20)
+	// no errors, no ratio
+	requestsTotal.WithLabelValues("web", "a").Add(10)
+
+	expected := `
+# HELP error_ratio Derived from {{ div (.Metric "errors_total") (.Metric "requests_total") }}
+# TYPE error_ratio gauge
+error_ratio{service="api"} 0.1
+`
+	gatherer := &serve.DerivedMetricsGatherer{Gatherer: registry, Metrics: cfg.DerivedMetrics}
+	assert.Nil(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected), "error_ratio"))
+
+	mfs, err := gatherer.Gather()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"error_ratio", "errors_total", "requests_total"}, []string{mfs[0].GetName(), mfs[1].GetName(), mfs[2].GetName()})
+}
@@ -0,0 +1,182 @@
+package serve
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+
+	"signalfx-prometheus-exporter/config"
+	. "signalfx-prometheus-exporter/utils"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// the flows of the loaded config, nil until flows are started
+var flowSupervision *flowSupervisor
+
+// runningFlow is a flow streaming in its own goroutine until it is stopped
+type runningFlow struct {
+	hash   string
+	cancel context.CancelFunc
+	done   chan struct{}
+	state  *flowState
+}
+
+// halted tells whether a flow stopped streaming, because it failed, gave up or
+// was disabled after too many failures. bounded programs that finished are not
+// halted.
+func (r *runningFlow) halted() bool {
+	select {
+	case <-r.done:
+		return r.state.currentState() != flowFinished
+	default:
+		return r.state.currentState() == flowDisabled
+	}
+}
+
+// flowSupervisor starts and stops the flows of a config.
+//
+// flows run in the errgroup of the exporter, so a failing flow still stops the
+// exporter in failFast mode.
+type flowSupervisor struct {
+	mu    sync.Mutex
+	ctx   context.Context
+	errs  *errgroup.Group
+	flows map[string]*runningFlow
+	// the config the exporter runs with, i.e. the settings it was started with
+	// and the flows of the last reload
+	applied *config.Config
+}
+
+func newFlowSupervisor(ctx context.Context, errs *errgroup.Group, cfg *config.Config) *flowSupervisor {
+	return &flowSupervisor{ctx: ctx, errs: errs, flows: make(map[string]*runningFlow), applied: cfg}
+}
+
+// start runs a flow, which must not be running already
+func (sv *flowSupervisor) start(fp config.FlowProgram) {
+	hash, err := fp.Hash()
+	if err != nil {
+		Log().Errorf("failed to hash flow %s: %+s", fp.Name, err)
+	}
+	setFlowLimiters(fp)
+	for _, warning := range fp.QueryWarnings() {
+		Log().Warnf("SignalFlow program for %s looks suspicious: %s", fp.Name, warning)
+	}
+	state := newFlowState(fp.Name, fp.Token(), fp.StalenessThreshold, fp.MaxConsecutiveFailures)
+	flowGaveUp.WithLabelValues(fp.Name).Set(0)
+	flowCircuitOpen.WithLabelValues(fp.Name).Set(0)
+	ctx, cancel := context.WithCancel(sv.ctx)
+	running := &runningFlow{hash: hash, cancel: cancel, done: make(chan struct{}), state: state}
+	sv.flows[fp.Name] = running
+	sv.errs.Go(func() error {
+		defer close(running.done)
+		return flowFailure(fp, runFlow(ctx, fp, state, func() error { return streamData(ctx, fp, state) }))
+	})
+}
+
+// stop ends a running flow and frees its series, vectors, self metrics and state
+func (sv *flowSupervisor) stop(name string) {
+	running := sv.flows[name]
+	running.cancel()
+	<-running.done
+	delete(sv.flows, name)
+	reapFlowSeries(name)
+	unregisterFlowMetrics(name)
+	deleteFlowSelfMetrics(name)
+	removeFlowState(name)
+}
+
+// reload applies the flows of a new config. new flows are started, removed
+// ones stopped and changed or halted ones restarted, while unchanged flows keep
+// streaming along with their series. returns the names of the affected flows.
+func (sv *flowSupervisor) reload(cfg *config.Config) (started, stopped, restarted []string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	started, stopped, restarted = []string{}, []string{}, []string{}
+	flows := make(map[string]config.FlowProgram, len(cfg.Flows))
+	for _, fp := range cfg.Flows {
+		flows[fp.Name] = fp
+	}
+	for name := range sv.flows {
+		if _, ok := flows[name]; !ok {
+			sv.stop(name)
+			stopped = append(stopped, name)
+		}
+	}
+	for _, fp := range cfg.Flows {
+		running, ok := sv.flows[fp.Name]
+		if !ok {
+			sv.start(fp)
+			started = append(started, fp.Name)
+			continue
+		}
+		if hash, err := fp.Hash(); err == nil && hash == running.hash && !running.halted() {
+			continue
+		}
+		sv.stop(fp.Name)
+		sv.start(fp)
+		restarted = append(restarted, fp.Name)
+	}
+	sort.Strings(stopped)
+	applied := *sv.applied
+	applied.Flows = cfg.Flows
+	applied.Credentials = cfg.Credentials
+	applied.FlowInfo = cfg.FlowInfo
+	sv.applied = &applied
+	return started, stopped, restarted
+}
+
+// appliedConfig returns the config the exporter runs with after the last reload
+func (sv *flowSupervisor) appliedConfig() *config.Config {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.applied
+}
+
+// ReloadOnSignal reloads the flows of the config file whenever a signal
+// arrives, e.g. SIGHUP. all other settings of the config keep the values they
+// were started with.
+func ReloadOnSignal(ctx context.Context, configFile string, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			reloadFlows(configFile)
+		}
+	}
+}
+
+// reloadFlows reloads the flows of the config file, keeping the running flows
+// if it fails to load
+func reloadFlows(configFile string) {
+	if err := reloadConfig(configFile); err != nil {
+		Log().Errorf("failed to reload config %s, keeping the running flows: %+s", configFile, err)
+		configReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	configReloads.WithLabelValues("success").Inc()
+}
+
+func reloadConfig(configFile string) error {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if flowSupervision == nil {
+		return nil
+	}
+	setRealmLimiters(cfg.RealmLimits())
+	started, stopped, restarted := flowSupervision.reload(cfg)
+	Log().Infof("Reloaded config %s, started flows %v, stopped flows %v, restarted flows %v", configFile, started, stopped, restarted)
+	// only the flows are applied, the hash covers the settings the exporter runs with
+	applied := flowSupervision.appliedConfig()
+	setConfigHash(applied)
+	if applied.FlowInfo {
+		setFlowInfo(applied)
+	} else {
+		flowInfo.Reset()
+	}
+	return nil
+}
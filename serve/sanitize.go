@@ -0,0 +1,37 @@
+package serve
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidLabelChars      = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// SanitizeMetricName turns a SignalFX metric name into a valid Prometheus
+// metric name, by replacing invalid characters like -, / or spaces with _ and
+// prefixing names that start with a digit with _
+func SanitizeMetricName(name string) string {
+	name = invalidMetricNameChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// SanitizeLabelName turns a SignalFX dimension name into a valid Prometheus
+// label name like SanitizeMetricName, except that colons are replaced as well
+// and leading underscores reserved for internal use are stripped
+func SanitizeLabelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	// labels starting with __ are reserved for internal use
+	for strings.HasPrefix(name, "__") {
+		name = name[1:]
+	}
+	return name
+}
@@ -0,0 +1,41 @@
+package serve_test
+
+import (
+	"signalfx-prometheus-exporter/serve"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	for name, sanitized := range map[string]string{
+		"cpu.utilization":      "cpu_utilization",
+		"http-requests/second": "http_requests_second",
+		"disk free bytes":      "disk_free_bytes",
+		"node:cpu:rate5m":      "node:cpu:rate5m",
+		"5xx.errors":           "_5xx_errors",
+		"latency.µs":           "latency__s",
+		"":                     "",
+	} {
+		assert.Equal(t, sanitized, serve.SanitizeMetricName(name), name)
+		if name != "" {
+			assert.True(t, model.IsValidMetricName(model.LabelValue(serve.SanitizeMetricName(name))), name)
+		}
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	for name, sanitized := range map[string]string{
+		"aws.region":     "aws_region",
+		"kubernetes/pod": "kubernetes_pod",
+		"host name":      "host_name",
+		"sf:key":         "sf_key",
+		"1st":            "_1st",
+		"__internal":     "_internal",
+		"":               "_",
+	} {
+		assert.Equal(t, sanitized, serve.SanitizeLabelName(name), name)
+		assert.True(t, model.LabelName(serve.SanitizeLabelName(name)).IsValid(), name)
+	}
+}
@@ -0,0 +1,174 @@
+package serve
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	selectorMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	selectorLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+)
+
+// VectorSelector selects series like an instant vector selector in PromQL,
+// e.g. `http_requests_total{job="api"}`
+type VectorSelector struct {
+	Name     string
+	Matchers []LabelMatcher
+}
+
+// types of label matchers, in the order they are tried while parsing
+const (
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+	MatchEqual     = "="
+)
+
+var matchTypes = []string{MatchNotEqual, MatchRegexp, MatchNotRegexp, MatchEqual}
+
+// LabelMatcher matches the value of a single label, a missing label has the
+// empty value. regular expressions are anchored like in PromQL.
+type LabelMatcher struct {
+	Name   string
+	Type   string
+	Value  string
+	regexp *regexp.Regexp
+}
+
+func newLabelMatcher(name string, matchType string, value string) (LabelMatcher, error) {
+	lm := LabelMatcher{Name: name, Type: matchType, Value: value}
+	if matchType == MatchRegexp || matchType == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return lm, fmt.Errorf("invalid regular expression for label %s - %s", name, err)
+		}
+		lm.regexp = re
+	}
+	return lm, nil
+}
+
+func (lm LabelMatcher) Matches(value string) bool {
+	switch lm.Type {
+	case MatchNotEqual:
+		return value != lm.Value
+	case MatchRegexp:
+		return lm.regexp.MatchString(value)
+	case MatchNotRegexp:
+		return !lm.regexp.MatchString(value)
+	default:
+		return value == lm.Value
+	}
+}
+
+// Matches tells whether a series of the metric family name is selected
+func (vs VectorSelector) Matches(name string, m *dto.Metric) bool {
+	if vs.Name != "" && vs.Name != name {
+		return false
+	}
+	for _, matcher := range vs.Matchers {
+		value := ""
+		if matcher.Name == model.MetricNameLabel {
+			value = name
+		} else {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == matcher.Name {
+					value = l.GetValue()
+					break
+				}
+			}
+		}
+		if !matcher.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseVectorSelector parses a selector of the form `name{label="value",...}`,
+// where either the name or the label matchers can be omitted. labels are matched
+// with =, !=, =~ or !~.
+func ParseVectorSelector(selector string) (VectorSelector, error) {
+	vs := VectorSelector{}
+	rest := strings.TrimSpace(selector)
+	vs.Name = selectorMetricName.FindString(rest)
+	rest = strings.TrimSpace(rest[len(vs.Name):])
+	if rest == "" {
+		if vs.Name == "" {
+			return vs, fmt.Errorf("Empty selector")
+		}
+		return vs, nil
+	}
+	if rest[0] != '{' {
+		return vs, fmt.Errorf("Invalid selector %q - expected { after the metric name", selector)
+	}
+	rest = rest[1:]
+	for {
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, "}") {
+			rest = rest[1:]
+			break
+		}
+		name := selectorLabelName.FindString(rest)
+		if name == "" {
+			return vs, fmt.Errorf("Invalid selector %q - expected a label name at %q", selector, rest)
+		}
+		rest = strings.TrimSpace(rest[len(name):])
+		matchType := ""
+		for _, t := range matchTypes {
+			if strings.HasPrefix(rest, t) {
+				matchType = t
+				break
+			}
+		}
+		if matchType == "" {
+			return vs, fmt.Errorf("Invalid selector %q - expected one of =, !=, =~ or !~ after label %s", selector, name)
+		}
+		value, remainder, err := unquotePrefix(strings.TrimSpace(rest[len(matchType):]))
+		if err != nil {
+			return vs, fmt.Errorf("Invalid selector %q - %s", selector, err)
+		}
+		matcher, err := newLabelMatcher(name, matchType, value)
+		if err != nil {
+			return vs, fmt.Errorf("Invalid selector %q - %s", selector, err)
+		}
+		vs.Matchers = append(vs.Matchers, matcher)
+
+		rest = strings.TrimSpace(remainder)
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if !strings.HasPrefix(rest, "}") {
+			return vs, fmt.Errorf("Invalid selector %q - expected , or } after label %s", selector, name)
+		}
+	}
+	if strings.TrimSpace(rest) != "" {
+		return vs, fmt.Errorf("Invalid selector %q - unexpected %q after }", selector, rest)
+	}
+	if vs.Name == "" && len(vs.Matchers) == 0 {
+		return vs, fmt.Errorf("Selector %q selects nothing", selector)
+	}
+	return vs, nil
+}
+
+// unquotePrefix unquotes the double quoted string s starts with and returns
+// the rest of s after it
+func unquotePrefix(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("label values have to be double quoted, got %q", s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			return value, s[i+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated label value %q", s)
+}
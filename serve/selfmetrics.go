@@ -0,0 +1,82 @@
+package serve
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// the self observability metrics on the health of flows, which configs with
+// selfMetrics also expose next to the data of the flows
+var selfMetricNames = map[string]bool{
+	"sfxpe_flow_last_received_seconds": true,
+	"sfxpe_flow_circuit_open":          true,
+	"sfxpe_flow_dead":                  true,
+	"sfxpe_flow_info":                  true,
+	"sfxpe_config_hash":                true,
+}
+
+// gathers the selfMetricNames for the scrape endpoints, nil without selfMetrics
+var selfGatherer prometheus.Gatherer
+
+func setupSelfMetrics() {
+	selfGatherer = &MetricFilteringGatherer{
+		Gatherer: prometheus.DefaultGatherer,
+		Filter: func(name string, m *dto.Metric) bool {
+			return selfMetricNames[name]
+		},
+	}
+}
+
+// withSelfMetrics adds the self metrics to the data of a scrape endpoint, if enabled
+func withSelfMetrics(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	if selfGatherer == nil {
+		return gatherer
+	}
+	return prometheus.Gatherers{gatherer, selfGatherer}
+}
+
+// flowLabeledVec is a self observability vector with a flow label
+type flowLabeledVec interface {
+	prometheus.Collector
+	Delete(prometheus.Labels) bool
+}
+
+// deleteFlowSelfMetrics removes the self observability series of a stopped
+// flow, so a removed flow doesn't linger and a restarted one starts over
+func deleteFlowSelfMetrics(flow string) {
+	vecs := []flowLabeledVec{
+		flowMetricsReceived, flowMetricsFailed, flowLastReceived, flowEventsReceived, flowEventsFailed,
+		flowSeriesLimited, flowCircuitOpen, flowCloses, flowReconnects, flowErrors, metadataDebounced,
+		metricSamples, flowGaveUp, flowMetricsSkipped, flowRateLimited, labelFallbacks,
+	}
+	for _, vec := range vecs {
+		for _, labels := range flowSeriesLabels(vec, flow) {
+			vec.Delete(labels)
+		}
+	}
+}
+
+// flowSeriesLabels collects the label sets of the series of a flow, vectors
+// can't be deleted from while collecting
+func flowSeriesLabels(vec prometheus.Collector, flow string) []prometheus.Labels {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(metrics)
+		close(metrics)
+	}()
+	var series []prometheus.Labels
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		labels := make(prometheus.Labels, len(m.GetLabel()))
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["flow"] == flow {
+			series = append(series, labels)
+		}
+	}
+	return series
+}
@@ -0,0 +1,160 @@
+package serve
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// trackedSeries is a single label combination of a metric written by a flow
+type trackedSeries struct {
+	flow        string
+	name        string
+	labelNames  []string
+	labelValues []string
+	lastUpdate  time.Time
+	// hides the series after this long without updates, never when zero
+	staleAfter time.Duration
+}
+
+func (s *trackedSeries) isStale(now time.Time) bool {
+	return s.staleAfter > 0 && now.Sub(s.lastUpdate) > s.staleAfter
+}
+
+// seriesTracker keeps track of the series flows have written to the sfxRegistry
+type seriesTracker struct {
+	mu     sync.Mutex
+	series map[string]*trackedSeries
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{series: make(map[string]*trackedSeries)}
+}
+
+func seriesKey(name string, labelValues []string) string {
+	return name + "\xff" + strings.Join(labelValues, "\xff")
+}
+
+func (st *seriesTracker) known(name string, labelValues []string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.series[seriesKey(name, labelValues)]
+	return ok
+}
+
+func (st *seriesTracker) touch(flow string, name string, labelNames []string, labelValues []string, staleAfter time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := seriesKey(name, labelValues)
+	s, ok := st.series[key]
+	if !ok {
+		s = &trackedSeries{flow: flow, name: name, labelNames: labelNames, labelValues: labelValues}
+		st.series[key] = s
+	}
+	s.lastUpdate = time.Now()
+	s.staleAfter = staleAfter
+}
+
+func (st *seriesTracker) countForFlow(flow string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	count := 0
+	for _, s := range st.series {
+		if s.flow == flow {
+			count++
+		}
+	}
+	return count
+}
+
+// removeFlow stops tracking all series of a flow and returns them
+func (st *seriesTracker) removeFlow(flow string) []*trackedSeries {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	removed := []*trackedSeries{}
+	for key, s := range st.series {
+		if s.flow == flow {
+			removed = append(removed, s)
+			delete(st.series, key)
+		}
+	}
+	return removed
+}
+
+// removeStale stops tracking all series that are stale at now and returns them
+func (st *seriesTracker) removeStale(now time.Time) []*trackedSeries {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	removed := []*trackedSeries{}
+	for key, s := range st.series {
+		if s.isStale(now) {
+			removed = append(removed, s)
+			delete(st.series, key)
+		}
+	}
+	return removed
+}
+
+// exposedSeriesKey identifies a series as it is exposed, independent of the
+// label order and without empty labels, which are the same as missing labels.
+func exposedSeriesKey(name string, labelNames []string, labelValues []string) string {
+	pairs := make([]string, 0, len(labelNames))
+	for i, labelName := range labelNames {
+		if labelValues[i] != "" {
+			pairs = append(pairs, labelName+"="+labelValues[i])
+		}
+	}
+	sort.Strings(pairs)
+	return name + "\xff" + strings.Join(pairs, "\xff")
+}
+
+// exposedKeysForFlow returns the exposedSeriesKey of all series of a flow
+func (st *seriesTracker) exposedKeysForFlow(flow string) map[string]bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys := make(map[string]bool)
+	for _, s := range st.series {
+		if s.flow == flow {
+			keys[exposedSeriesKey(s.name, s.labelNames, s.labelValues)] = true
+		}
+	}
+	return keys
+}
+
+// exposedLastUpdates returns the last update of all series by their exposedSeriesKey
+func (st *seriesTracker) exposedLastUpdates() map[string]time.Time {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	lastUpdates := make(map[string]time.Time, len(st.series))
+	for _, s := range st.series {
+		lastUpdates[exposedSeriesKey(s.name, s.labelNames, s.labelValues)] = s.lastUpdate
+	}
+	return lastUpdates
+}
+
+// gatheredSeriesKey is the exposedSeriesKey of a gathered metric
+func gatheredSeriesKey(name string, m *dto.Metric) string {
+	labelNames := make([]string, len(m.GetLabel()))
+	labelValues := make([]string, len(m.GetLabel()))
+	for i, l := range m.GetLabel() {
+		labelNames[i] = l.GetName()
+		labelValues[i] = l.GetValue()
+	}
+	return exposedSeriesKey(name, labelNames, labelValues)
+}
+
+// exposedStaleKeys returns the exposedSeriesKey of all series that are stale at now
+func (st *seriesTracker) exposedStaleKeys(now time.Time) map[string]bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys := make(map[string]bool)
+	for _, s := range st.series {
+		if s.isStale(now) {
+			keys[exposedSeriesKey(s.name, s.labelNames, s.labelValues)] = true
+		}
+	}
+	return keys
+}
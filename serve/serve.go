@@ -2,22 +2,56 @@ package serve
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"signalfx-prometheus-exporter/config"
 	. "signalfx-prometheus-exporter/utils"
+	"signalfx-prometheus-exporter/version"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/signalfx/signalfx-go/idtool"
 	"github.com/signalfx/signalfx-go/signalflow"
 	"github.com/signalfx/signalfx-go/signalflow/messages"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+// reasons for skipped metrics
+const (
+	skippedNoMetricName = "no_metric_name"
+	skippedPredicate    = "predicate"
+	skippedUnmapped     = "unmapped"
+)
+
+// the stream label of payloads without metadata
+const streamUnknown = "unknown"
+
+// time without dropped payloads after which an ingestion rate limit counts as disengaged
+const ingestionLimitQuietPeriod = 10 * time.Second
+
+// how the exporter treats a config without flows
+const (
+	NoFlowsWarn    = "warn"
+	NoFlowsFail    = "fail"
+	NoFlowsUnready = "unready"
 )
 
 var (
@@ -25,16 +59,110 @@ var (
 	sfxRegistry               = prometheus.NewRegistry()
 	sfxCounters               = make(map[string]*prometheus.CounterVec)
 	sfxGauges                 = make(map[string]*prometheus.GaugeVec)
+	sfxHistograms             = make(map[string]*prometheus.HistogramVec)
+	sfxSummaries              = make(map[string]*prometheus.SummaryVec)
+	sfxLabelNames             = make(map[string][]string)
+	sfxMetricFlows            = make(map[string]map[string]bool)
+	sfxMetricsLock            sync.RWMutex
 	lastMetricInFlowTimestamp = make(map[string]time.Time)
+	sfxSeries                 = newSeriesTracker()
+	sfxLabels                 = newLabelCache()
+	gaugeDecimator            = NewGaugeDecimator()
+	sfxLastValues             = newLastValueStore()
+
+	// signalflow client options for a SignalFX connection
+	signalflowClientParams = func(fp config.FlowProgram) []signalflow.ClientParam {
+		return []signalflow.ClientParam{
+			signalflow.StreamURLForRealm(fp.Realm()),
+			signalflow.AccessToken(fp.Token()),
+			signalflow.UserAgent(fp.UserAgent),
+		}
+	}
+
+	// per flow limits, replaced when flows are reloaded
+	flowLimitersLock sync.RWMutex
+
+	// per flow limits for the registration of new series
+	seriesLimiters           = make(map[string]*rate.Limiter)
+	seriesLimiterEngaged     = make(map[string]bool)
+	seriesLimiterEngagedLock sync.Mutex
+	errSeriesRateLimited     = errors.New("series registration rate limit exceeded")
+
+	// per flow and global limits for the ingestion of payloads
+	ingestionLimiters      = make(map[string]*rate.Limiter)
+	globalIngestionLimiter *rate.Limiter
+	ingestionLimited       = make(map[string]time.Time)
+	ingestionLimitedLock   sync.Mutex
+
+	// timeout of scrapes that don't send X-Prometheus-Scrape-Timeout-Seconds
+	scrapeTimeout = 5 * time.Second
+
+	// stops the exporter once a single flow failed for good
+	failFast bool
+
+	// decides which payloads of flows with a debugSampleRate are logged
+	sampleRand = rand.Float64
+
+	// reports not ready, for configs without flows in NoFlowsUnready mode
+	noFlowsUnready bool
+
+	// reports ready from then on, even with flows that received no data yet
+	readyAfter time.Time
+
+	// time series whose metadata didn't arrive (yet)
+	errNoMetadata = errors.New("no metadata for time series")
+
+	// returned by streamData once the circuit breaker of the flow opened
+	errCircuitOpen = errors.New("flow disabled after too many consecutive failures")
+
+	// metrics of flows that drop labels with empty values
+	compactedMetrics sync.Map
+
+	// gatherers used by the scrape handlers, wrapping the sfxRegistry
+	sfxBaseGatherer prometheus.Gatherer = &LabelCompactingGatherer{
+		Gatherer: sfxRegistry,
+		Compact: func(name string) bool {
+			_, ok := compactedMetrics.Load(name)
+			return ok
+		},
+	}
+	sfxGatherer     prometheus.Gatherer = sfxBaseGatherer
+	expositionCache *ExpositionCache
 
 	// self observability
 	flowMetricsReceived *prometheus.CounterVec
 	flowMetricsFailed   *prometheus.CounterVec
 	flowLastReceived    *prometheus.GaugeVec
+	flowEventsReceived  *prometheus.CounterVec
+	flowEventsFailed    *prometheus.CounterVec
+	flowSeriesLimited   *prometheus.CounterVec
+	flowCircuitOpen     *prometheus.GaugeVec
+	gatherErrors        *prometheus.CounterVec
+	flowMetricsSkipped  *prometheus.CounterVec
+	flowRateLimited     *prometheus.CounterVec
+	flowCloses          *prometheus.CounterVec
+	flowReconnects      *prometheus.CounterVec
+	flowErrors          *prometheus.CounterVec
+	metadataDebounced   *prometheus.CounterVec
+	metricSamples       *prometheus.CounterVec
+	configHash          *prometheus.GaugeVec
+	probesRejected      prometheus.Counter
+	probeResponseBytes  *prometheus.HistogramVec
+	probeGatherAlloc    *prometheus.GaugeVec
+	registryGatherTime  *prometheus.HistogramVec
+	flowGaveUp          *prometheus.GaugeVec
+	flowInfo            *prometheus.GaugeVec
+	realmFlowsQueued    *prometheus.GaugeVec
+	staleSeriesReaped   prometheus.Counter
+	buildInfo           *prometheus.GaugeVec
+	configReloads       *prometheus.CounterVec
+	labelFallbacks      *prometheus.CounterVec
 )
 
-func setupObservability(observabilityPort int) {
-	// configure and start observability server
+// how often series past their staleAfter are freed, scrapes hide them right away
+const staleSeriesReapInterval = time.Minute
+
+func setupObservabilityMetrics() {
 	flowMetricsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "sfxpe_flow_metrics_received_total",
 		Help: "Number of received metrics",
@@ -47,47 +175,368 @@ func setupObservability(observabilityPort int) {
 		Name: "sfxpe_flow_last_received_seconds",
 		Help: "Timestamp where the last metric was received",
 	}, []string{"flow", "stream"})
+	flowEventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_events_received_total",
+		Help: "Number of received events",
+	}, []string{"flow", "stream"})
+	flowEventsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_events_failed_total",
+		Help: "Number of events that failed to process",
+	}, []string{"flow", "stream"})
+	flowSeriesLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_series_rate_limited_total",
+		Help: "Number of new series that were dropped by the registration rate limit",
+	}, []string{"flow"})
+	flowCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_flow_circuit_open",
+		Help: "Whether the flow was disabled after too many consecutive failures",
+	}, []string{"flow"})
+	flowCloses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_closes_total",
+		Help: "Number of times the SignalFlow stream of a flow ended",
+	}, []string{"flow", "code", "reason"})
+	flowReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_reconnects_total",
+		Help: "Number of times a flow reconnected after its SignalFlow stream dropped",
+	}, []string{"flow"})
+	flowErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_errors_total",
+		Help: "Number of times a flow failed for good, e.g. because of a rejected token or program",
+	}, []string{"flow"})
+	metadataDebounced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_metadata_debounced_total",
+		Help: "Number of metadata updates held back until the metadata of the time series stopped changing",
+	}, []string{"flow"})
+	metricSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_metric_samples_total",
+		Help: "Number of payloads processed per metric, for flows with countSamples",
+	}, []string{"flow", "metric"})
+	configHash = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_config_hash",
+		Help: "Digest of the loaded config, differing digests across replicas indicate an inconsistent rollout",
+	}, []string{"hash"})
+	probesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_probes_rejected_total",
+		Help: "Number of probe scrapes rejected by the probe concurrency limit",
+	})
+	probeResponseBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sfxpe_probe_response_bytes",
+		Help:    "Size of probe scrape responses as sent, i.e. compressed if the scraper asked for it",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"grouping"})
+	probeGatherAlloc = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_probe_gather_alloc_bytes",
+		Help: "Heap allocated while gathering the last probe scrape, including concurrent allocations of the process",
+	}, []string{"grouping"})
+	registryGatherTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "sfxpe_registry_gather_duration_seconds",
+		Help: "Time a probe scrape took to gather and filter the registry, by whether match selectors were applied",
+	}, []string{"grouping", "matched"})
+	flowGaveUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_flow_dead",
+		Help: "Whether the flow gave up reconnecting after maxReconnects attempts",
+	}, []string{"flow"})
+	flowInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_flow_info",
+		Help: "Configuration summary of a flow",
+	}, []string{"flow", "realm", "types", "streams"})
+	realmFlowsQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_realm_flows_queued",
+		Help: "Number of flows waiting for a free SignalFlow program slot of the realm",
+	}, []string{"realm"})
+	staleSeriesReaped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sfxpe_stale_series_reaped_total",
+		Help: "Number of series freed after not being updated for their staleAfter",
+	})
+	flowMetricsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_metrics_skipped_total",
+		Help: "Number of received metrics that were skipped on purpose",
+	}, []string{"flow", "stream", "reason"})
+	flowRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_rate_limited_total",
+		Help: "Number of received metrics that were dropped by the ingestion rate limit",
+	}, []string{"flow"})
+	gatherErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_gather_errors_total",
+		Help: "Number of errors while gathering the exported metrics",
+	}, []string{"family"})
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_config_reloads_total",
+		Help: "Number of config reloads triggered by SIGHUP or --watch-config, by whether the new config could be loaded",
+	}, []string{"result"})
+	labelFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_label_fallbacks_total",
+		Help: "Number of labels that failed to render and fell back according to labelErrors",
+	}, []string{"flow", "label"})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_build_info",
+		Help: "Version, commit and Go version of the running exporter build, always 1",
+	}, []string{"version", "commit", "goversion"})
 	prometheus.MustRegister(flowMetricsReceived)
 	prometheus.MustRegister(flowMetricsFailed)
 	prometheus.MustRegister(flowLastReceived)
+	prometheus.MustRegister(flowEventsReceived)
+	prometheus.MustRegister(flowEventsFailed)
+	prometheus.MustRegister(flowSeriesLimited)
+	prometheus.MustRegister(flowCircuitOpen)
+	prometheus.MustRegister(gatherErrors)
+	prometheus.MustRegister(flowMetricsSkipped)
+	prometheus.MustRegister(flowRateLimited)
+	prometheus.MustRegister(flowCloses)
+	prometheus.MustRegister(flowReconnects)
+	prometheus.MustRegister(flowErrors)
+	prometheus.MustRegister(metadataDebounced)
+	prometheus.MustRegister(metricSamples)
+	prometheus.MustRegister(configHash)
+	prometheus.MustRegister(probesRejected)
+	prometheus.MustRegister(probeResponseBytes)
+	prometheus.MustRegister(probeGatherAlloc)
+	prometheus.MustRegister(registryGatherTime)
+	prometheus.MustRegister(flowGaveUp)
+	prometheus.MustRegister(flowInfo)
+	prometheus.MustRegister(realmFlowsQueued)
+	prometheus.MustRegister(staleSeriesReaped)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(configReloads)
+	prometheus.MustRegister(labelFallbacks)
+	buildInfo.WithLabelValues(version.Version, version.Commit, runtime.Version()).Set(1)
+}
+
+// setConfigHash exposes the digest of the loaded config, replacing the one of a previous config
+func setConfigHash(cfg *config.Config) {
+	hash, err := cfg.Hash()
+	if err != nil {
+		Log().Errorf("failed to hash config: %+s", err)
+		return
+	}
+	configHash.Reset()
+	configHash.WithLabelValues(hash).Set(1)
+}
+
+// setFlowInfo exposes a summary of the configuration of every flow
+func setFlowInfo(cfg *config.Config) {
+	flowInfo.Reset()
+	for _, fp := range cfg.Flows {
+		types := make(map[string]bool)
+		for _, mt := range fp.MetricTemplates {
+			types[mt.Type] = true
+		}
+		if len(fp.EventTemplates) > 0 {
+			types["event"] = true
+		}
+		typeNames := make([]string, 0, len(types))
+		for t := range types {
+			typeNames = append(typeNames, t)
+		}
+		sort.Strings(typeNames)
+		streams := len(fp.MetricTemplates) + len(fp.EventTemplates)
+		flowInfo.WithLabelValues(fp.Name, fp.Realm(), strings.Join(typeNames, ","), strconv.Itoa(streams)).Set(1)
+	}
+}
+
+func setupObservability(observabilityPort int, tlsConfig *tls.Config) (*http.Server, error) {
+	// configure and start observability server
+	setupObservabilityMetrics()
+	return startObservabilityServer(observabilityPort, tlsConfig)
+}
+
+func startObservabilityServer(observabilityPort int, tlsConfig *tls.Config) (*http.Server, error) {
 	obsMux := mux.NewRouter()
 	obsMux.Handle("/metrics", promhttp.Handler())
-	obsServer := &http.Server{Addr: fmt.Sprintf(":%v", observabilityPort), Handler: obsMux}
+	obsMux.HandleFunc("/healthz", livenessHandler)
+	obsMux.HandleFunc("/ready", readinessHandler)
+	obsMux.HandleFunc("/-/flow/{name}/status", flowStatusHandler)
+	obsMux.HandleFunc("/-/flow/{name}/resume", flowResumeHandler).Methods(http.MethodPost)
+	obsMux.HandleFunc("/-/dump", dumpHandler).Methods(http.MethodGet)
+	obsServer := &http.Server{Handler: obsMux, TLSConfig: tlsConfig}
+
+	// bind right away, so a port conflict is reported before anything else starts
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", observabilityPort))
+	if err != nil {
+		return nil, fmt.Errorf("Observability server can't listen on port %v - %s", observabilityPort, err)
+	}
 	go func() {
-		if err := obsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			Log().Fatalf("observability server failure: %+s", err)
+		var err error
+		if tlsConfig != nil {
+			err = obsServer.ServeTLS(listener, "", "")
+		} else {
+			err = obsServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			Log().Errorf("observability server failure on port %v: %+s", observabilityPort, err)
 		}
 	}()
 	Log().Infof("Observability server listening on port %v", observabilityPort)
+	return obsServer, nil
+}
+
+func setupExpositionCache(interval time.Duration, ctx context.Context) {
+	expositionCache = &ExpositionCache{Gatherer: withSelfMetrics(sfxBaseGatherer)}
+	sfxGatherer = expositionCache
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sfxpe_exposition_cache_age_seconds",
+		Help: "Time since the exposition cache was last refreshed",
+	}, func() float64 {
+		return expositionCache.Age().Seconds()
+	}))
+	go expositionCache.Run(ctx, interval)
+	Log().Infof("Serving scrapes from exposition cache refreshed every %v", interval)
+}
+
+func setupStaleSeriesReaper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(staleSeriesReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				staleSeriesReaped.Add(float64(reapStaleSeries(time.Now())))
+			}
+		}
+	}()
 }
 
 func setupMetricStreaming(cfg *config.Config, ctx context.Context) context.Context {
 	errs, ctx := errgroup.WithContext(ctx)
-	for i := range cfg.Flows {
-		fp := cfg.Flows[i]
-		errs.Go(func() error {
-			err := streamData(cfg.Sfx, fp)
-			Log().Errorf("Flow %s failed because of %+s", fp.Name, err)
-			return err
-		})
+	if cfg.IngestionRateLimit != nil {
+		globalIngestionLimiter = rate.NewLimiter(rate.Limit(cfg.IngestionRateLimit.Rate), cfg.IngestionRateLimit.Burst)
+	}
+	setRealmLimiters(cfg.RealmLimits())
+	flowSupervision = newFlowSupervisor(ctx, errs, cfg)
+	for _, fp := range cfg.Flows {
+		flowSupervision.start(fp)
 	}
 	return ctx
 }
 
-func serve(cfg *config.Config, listenPort int, ctx context.Context) {
+// setFlowLimiters sets up the rate limits of a flow, replacing previous ones
+func setFlowLimiters(fp config.FlowProgram) {
+	flowLimitersLock.Lock()
+	defer flowLimitersLock.Unlock()
+	delete(seriesLimiters, fp.Name)
+	delete(ingestionLimiters, fp.Name)
+	if fp.RegistrationRateLimit != nil {
+		seriesLimiters[fp.Name] = rate.NewLimiter(rate.Limit(fp.RegistrationRateLimit.Rate), fp.RegistrationRateLimit.Burst)
+	}
+	if fp.IngestionRateLimit != nil {
+		ingestionLimiters[fp.Name] = rate.NewLimiter(rate.Limit(fp.IngestionRateLimit.Rate), fp.IngestionRateLimit.Burst)
+	}
+}
+
+// flowFailure counts a flow that failed for good, which only stops the
+// exporter along with all other flows in failFast mode
+func flowFailure(fp config.FlowProgram, err error) error {
+	if err == nil {
+		return nil
+	}
+	flowErrors.WithLabelValues(fp.Name).Inc()
+	if failFast {
+		Log().Errorf("Stopping the exporter because flow %s failed", fp.Name)
+		return err
+	}
+	return nil
+}
+
+// runFlow streams a flow until it ends for good, reconnecting dropped streams.
+//
+// only the errors of flows that failed for good are returned, flows that
+// finished, were stopped or gave up reconnecting return nil.
+func runFlow(ctx context.Context, fp config.FlowProgram, state *flowState, stream func() error) error {
+	backoff := fp.ReconnectBackoff
+	reconnects := 0
+	limiter := getRealmLimiter(fp.Realm())
+	for {
+		if limiter != nil && !limiter.tryAcquire() {
+			Log().Infof("Flow %s is queued until fewer than %d SignalFlow programs run against realm %s", fp.Name, cap(limiter.slots), fp.Realm())
+			state.setState(flowQueued)
+			if !limiter.wait(ctx) {
+				return nil
+			}
+			state.setState(flowConnecting)
+		}
+		started := time.Now()
+		err := stream()
+		if limiter != nil {
+			limiter.release()
+		}
+		if ctx.Err() != nil {
+			// stopped, along with the exporter or by a reload
+			return nil
+		}
+		if err == errCircuitOpen {
+			Log().Errorf("Flow %s is DISABLED after %d consecutive failures, fix the flow and resume it via POST /-/flow/%s/resume", fp.Name, fp.MaxConsecutiveFailures, fp.Name)
+			if !state.waitForResume(ctx) {
+				return nil
+			}
+			continue
+		}
+		reason, code := classifyClose(err)
+		flowCloses.WithLabelValues(fp.Name, code, reason).Inc()
+		switch reason {
+		case closeCompleted:
+			Log().Infof("Flow %s finished", fp.Name)
+			return nil
+		case closeTransient:
+			// only reconnects that never got a stream going count towards the limit
+			if state.receivedSince(started) {
+				reconnects = 0
+			}
+			reconnects++
+			if fp.MaxReconnects > 0 && reconnects > fp.MaxReconnects {
+				Log().Errorf("Flow %s is DEAD after %d reconnects without receiving data, last error: %+s", fp.Name, fp.MaxReconnects, err)
+				state.setError(err)
+				state.setState(flowDead)
+				flowGaveUp.WithLabelValues(fp.Name).Set(1)
+				return nil
+			}
+			// a stream that ran for a while was established, so the backoff starts over
+			if time.Since(started) >= fp.StableStreamDuration {
+				backoff = fp.ReconnectBackoff
+			}
+			Log().Warnf("Flow %s stream closed because of %+s, reconnecting in %v", fp.Name, err, backoff)
+			state.reconnecting(err)
+			flowReconnects.WithLabelValues(fp.Name).Inc()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = nextBackoff(backoff, fp.MaxReconnectBackoff)
+			continue
+		case closeAuth:
+			Log().Errorf("Flow %s was rejected by SignalFX, check the token: %+s", fp.Name, err)
+		default:
+			Log().Errorf("Flow %s failed because of %+s", fp.Name, err)
+		}
+		state.setError(err)
+		return err
+	}
+}
+
+func serve(cfg *config.Config, listenPort int, tlsConfig *tls.Config, obsServer *http.Server, ctx context.Context) {
 	// configure and start scrape server
 	mux := mux.NewRouter()
 	mux.HandleFunc("/ready", readinessHandler)
 	mux.HandleFunc("/healthy", livenessHandler)
 	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/-/targets", targetsHandler)
 	for _, g := range cfg.Groupings {
 		mux.HandleFunc(fmt.Sprintf("/metrics/%s", g.Label), func(rw http.ResponseWriter, r *http.Request) {
 			probeHandler(g, rw, r)
 		})
 	}
-	server := &http.Server{Addr: fmt.Sprintf(":%v", listenPort), Handler: mux}
+	server := &http.Server{Addr: fmt.Sprintf(":%v", listenPort), Handler: mux, TLSConfig: tlsConfig}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			// the certificate is part of the TLSConfig already
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			Log().Fatalf("metrics server failure: %+s", err)
 		}
 	}()
@@ -95,30 +544,208 @@ func serve(cfg *config.Config, listenPort int, ctx context.Context) {
 
 	<-ctx.Done()
 
-	Log().Info("Server stopped")
-
 	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer func() {
 		cancel()
 	}()
 
-	if err := server.Shutdown(ctxShutDown); err != nil {
-		Log().Errorf("server Shutdown Failed: %+s", err)
+	shutdownServers(ctxShutDown, map[string]*http.Server{"scrape": server, "observability": obsServer})
+	Log().Info("Server stopped")
+}
+
+// shutdownServers shuts down all servers at once, a failing one doesn't keep
+// the others from shutting down. nil servers are skipped.
+func shutdownServers(ctx context.Context, servers map[string]*http.Server) {
+	var wg sync.WaitGroup
+	for name, server := range servers {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				Log().Errorf("%s server Shutdown Failed: %+s", name, err)
+			}
+		}(name, server)
 	}
+	wg.Wait()
+}
+
+// Options are the settings of the exporter that don't come from the config
+// file, i.e. the flags of the serve command
+type Options struct {
+	ConfigFile         string
+	ConfigWait         time.Duration
+	ConfigWaitInterval time.Duration
+	ListenPort         int
+	ObservabilityPort  int
+	// ObservabilityOptional keeps serving scrapes when the observability server
+	// can't listen on its port
+	ObservabilityOptional     bool
+	GatherCacheTTL            time.Duration
+	ExpositionRefreshInterval time.Duration
+	// WatchConfig reloads the flows when the config file changes
+	WatchConfig bool
+	// ReloadSignals reloads the flows on every signal, e.g. SIGHUP
+	ReloadSignals       <-chan os.Signal
+	MaxConcurrentProbes int
+	// ScrapeTimeout applies to scrapes without a timeout header
+	ScrapeTimeout time.Duration
+	// NoFlows is one of NoFlowsWarn, NoFlowsFail or NoFlowsUnready
+	NoFlows string
+	// FailFast stops the exporter when a single flow fails for good
+	FailFast         bool
+	DumpBearerToken  string
+	ReadyGracePeriod time.Duration
+	TLSCert          string
+	TLSKey           string
+	TLSClientCA      string
 }
 
-func CollectoAndServe(configFile string, listenPort int, observabilityPort int, ctx context.Context) {
-	cfg, err := config.LoadConfig(configFile)
+func CollectoAndServe(opts Options, ctx context.Context) {
+	if opts.NoFlows != NoFlowsWarn && opts.NoFlows != NoFlowsFail && opts.NoFlows != NoFlowsUnready {
+		Log().Errorf("invalid no flows behavior %s, must be one of %s, %s or %s", opts.NoFlows, NoFlowsWarn, NoFlowsFail, NoFlowsUnready)
+		return
+	}
+	if opts.GatherCacheTTL > 0 && opts.ExpositionRefreshInterval > 0 {
+		// scrapes are served from the exposition cache, which would bypass the gather cache
+		Log().Errorf("--gather-cache-ttl and --exposition-refresh-interval are mutually exclusive")
+		return
+	}
+	var tlsFlags *config.TLS
+	if opts.TLSCert != "" || opts.TLSKey != "" || opts.TLSClientCA != "" {
+		tlsFlags = &config.TLS{CertFile: opts.TLSCert, KeyFile: opts.TLSKey, ClientCAFile: opts.TLSClientCA}
+		if err := tlsFlags.Validate(); err != nil {
+			Log().Errorf("invalid TLS flags: %+s", err)
+			return
+		}
+	}
+	if err := WaitForConfig(ctx, opts.ConfigFile, opts.ConfigWait, opts.ConfigWaitInterval); err != nil {
+		Log().Errorf("failed to load config: %+s", err)
+		return
+	}
+	cfg, err := config.LoadConfig(opts.ConfigFile)
 	if err != nil {
 		Log().Errorf("failed to load config: %+s", err)
 		return
 	}
-	setupObservability(observabilityPort)
+	if len(cfg.Flows) == 0 {
+		// most likely an empty config file, e.g. from a broken ConfigMap
+		switch opts.NoFlows {
+		case NoFlowsFail:
+			Log().Errorf("config %s has no flows", opts.ConfigFile)
+			return
+		case NoFlowsUnready:
+			Log().Warnf("config %s has no flows, reporting not ready", opts.ConfigFile)
+			noFlowsUnready = true
+		default:
+			Log().Warnf("config %s has no flows, no metrics will be served", opts.ConfigFile)
+		}
+	}
+	if cfg.NameMappingFile != "" {
+		if err := setupNameMapping(cfg.NameMappingFile, ctx); err != nil {
+			Log().Errorf("failed to load name mapping: %+s", err)
+			return
+		}
+	}
+	dumpToken = opts.DumpBearerToken
+	if opts.ReadyGracePeriod > 0 {
+		readyAfter = time.Now().Add(opts.ReadyGracePeriod)
+	}
+	failFast = opts.FailFast
+	if opts.ScrapeTimeout > 0 {
+		scrapeTimeout = opts.ScrapeTimeout
+	}
+	// the flags take precedence over the config
+	tlsSettings := cfg.TLS
+	if tlsFlags != nil {
+		tlsSettings = tlsFlags
+	}
+	scrapeTLS, err := serverTLSConfig(tlsSettings, true)
+	if err != nil {
+		Log().Errorf("failed to set up TLS: %+s", err)
+		return
+	}
+	obsTLS, err := serverTLSConfig(tlsSettings, false)
+	if err != nil {
+		Log().Errorf("failed to set up TLS: %+s", err)
+		return
+	}
+	obsServer, err := setupObservability(opts.ObservabilityPort, obsTLS)
+	if err != nil {
+		if !opts.ObservabilityOptional {
+			Log().Errorf("failed to start observability server: %+s", err)
+			return
+		}
+		Log().Warnf("continuing without observability server: %+s", err)
+	}
+	setConfigHash(cfg)
+	if cfg.FlowInfo {
+		setFlowInfo(cfg)
+	}
+	if cfg.SelfMetrics {
+		setupSelfMetrics()
+	}
+	sfxBaseGatherer = &StaleSeriesGatherer{Gatherer: sfxBaseGatherer, Stale: sfxSeries.exposedStaleKeys}
+	if len(cfg.DerivedMetrics) > 0 {
+		sfxBaseGatherer = &DerivedMetricsGatherer{Gatherer: sfxBaseGatherer, Metrics: cfg.DerivedMetrics}
+	}
+	sfxBaseGatherer = &ErrorCountingGatherer{
+		Gatherer: &LabelOrderingGatherer{Gatherer: sfxBaseGatherer, Order: cfg.LabelOrder},
+		Errors:   gatherErrors,
+	}
+	sfxGatherer = sfxBaseGatherer
+	if opts.GatherCacheTTL > 0 {
+		sfxGatherer = &CachingGatherer{Gatherer: sfxBaseGatherer, TTL: opts.GatherCacheTTL}
+	}
+	if cfg.Kafka != nil {
+		setupKafka(*cfg.Kafka, ctx)
+	}
 	ctx = setupMetricStreaming(cfg, ctx)
-	serve(cfg, listenPort, ctx)
+	go ReloadOnSignal(ctx, opts.ConfigFile, opts.ReloadSignals)
+	if opts.WatchConfig {
+		err := WatchConfig(ctx, opts.ConfigFile, func() {
+			Log().Infof("Config file %s changed, reloading its flows", opts.ConfigFile)
+			reloadFlows(opts.ConfigFile)
+		})
+		if err != nil {
+			Log().Errorf("failed to watch config: %+s", err)
+			return
+		}
+	}
+	setupStaleSeriesReaper(ctx)
+	if opts.ExpositionRefreshInterval > 0 {
+		setupExpositionCache(opts.ExpositionRefreshInterval, ctx)
+	}
+	if cfg.Graphite != nil {
+		setupGraphite(*cfg.Graphite, ctx)
+	}
+	if cfg.CloudWatch != nil {
+		setupCloudWatch(*cfg.CloudWatch, ctx)
+	}
+	if opts.MaxConcurrentProbes > 0 {
+		probeLimit = newProbeLimiter(opts.MaxConcurrentProbes)
+	}
+	serve(cfg, opts.ListenPort, scrapeTLS, obsServer, ctx)
+}
+
+// Readiness is the json body of /ready while flows are not ready yet
+type Readiness struct {
+	Unready []string `json:"unready"`
 }
 
 func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if noFlowsUnready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if unready := unreadyFlows(); len(unready) > 0 && (readyAfter.IsZero() || time.Now().Before(readyAfter)) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Readiness{Unready: unready})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -126,21 +753,75 @@ func livenessHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// scrapeTimeoutFor is the timeout of a scrape, the timeout query parameter or
+// else the configured scrapeTimeout. the scrape timeout sent by Prometheus caps
+// the timeout, or replaces the configured one. it never exceeds the deadline of
+// the request.
+func scrapeTimeoutFor(r *http.Request) time.Duration {
+	timeout := scrapeTimeout
+	requested := false
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		if d, err := time.ParseDuration(param); err == nil && d > 0 {
+			timeout = d
+			requested = true
+		}
+	}
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+			scraperTimeout := time.Duration(seconds * float64(time.Second))
+			if !requested || scraperTimeout < timeout {
+				timeout = scraperTimeout
+			}
+		}
+	}
+	if deadline, ok := r.Context().Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	Log().Debugf("Scrape of %s times out after %v", r.URL.Path, timeout)
+	return timeout
+}
+
 func probeHandler(grouping config.Grouping, w http.ResponseWriter, r *http.Request) {
 	// blackbox exporter compatible scrape handler
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(5*float64(time.Second)))
+	if probeLimit != nil {
+		if !probeLimit.acquire() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer probeLimit.release()
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeoutFor(r))
 	defer cancel()
 	r = r.WithContext(ctx)
 
 	targetValue, ok := r.URL.Query()["target"]
 	if ok && len(targetValue) > 0 {
-		metricGatherer := &FilteringRegistry{
-			Registry:    sfxRegistry,
-			Grouping:    grouping,
-			FilterValue: targetValue[0],
+		selectors := []VectorSelector{}
+		for _, param := range []string{"match[]", "match"} {
+			for _, match := range r.URL.Query()[param] {
+				vs, err := ParseVectorSelector(match)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				selectors = append(selectors, vs)
+			}
 		}
-		h := promhttp.HandlerFor(metricGatherer, promhttp.HandlerOpts{})
-		h.ServeHTTP(w, r)
+		gatherTime := registryGatherTime.WithLabelValues(grouping.Label, strconv.FormatBool(len(selectors) > 0))
+		metricGatherer := &allocMeasuringGatherer{Gatherer: &timingGatherer{
+			Gatherer: &FilteringRegistry{
+				Registry:    sfxGatherer,
+				Grouping:    grouping,
+				FilterValue: targetValue[0],
+				Selectors:   selectors,
+			},
+			Observe: func(d time.Duration) { gatherTime.Observe(d.Seconds()) },
+		}}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		h := promhttp.HandlerFor(withSelfMetrics(metricGatherer), promhttp.HandlerOpts{})
+		h.ServeHTTP(cw, r)
+		probeResponseBytes.WithLabelValues(grouping.Label).Observe(float64(cw.written))
+		probeGatherAlloc.WithLabelValues(grouping.Label).Set(float64(metricGatherer.Allocated))
 		return
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
@@ -149,151 +830,941 @@ func probeHandler(grouping config.Grouping, w http.ResponseWriter, r *http.Reque
 
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	// renders all metrics
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(5*float64(time.Second)))
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeoutFor(r))
 	defer cancel()
 	r = r.WithContext(ctx)
-	h := promhttp.HandlerFor(sfxRegistry, promhttp.HandlerOpts{})
+	if flow := r.URL.Query().Get("flow"); flow != "" {
+		// only the series of a single flow, as discovered via /-/targets
+		if _, ok := getFlowState(flow); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		keys := sfxSeries.exposedKeysForFlow(flow)
+		h := promhttp.HandlerFor(&MetricFilteringGatherer{
+			Gatherer: sfxGatherer,
+			Filter: func(name string, m *dto.Metric) bool {
+				return keys[gatheredSeriesKey(name, m)]
+			},
+		}, promhttp.HandlerOpts{})
+		h.ServeHTTP(w, r)
+		return
+	}
+	if expositionCache != nil {
+		expositionCache.ServeHTTP(w, r)
+		return
+	}
+	h := promhttp.HandlerFor(withSelfMetrics(sfxGatherer), promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
 }
 
-func streamData(sfx config.Sfx, fp config.FlowProgram) error {
+// targetGroup is a target group of the Prometheus HTTP service discovery
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// targetsHandler lists one target per flow in the Prometheus HTTP service
+// discovery format, each scraping only the series of its flow. the targets
+// point to the host the discovery request was sent to.
+func targetsHandler(w http.ResponseWriter, r *http.Request) {
+	flowStatesLock.RLock()
+	flows := make([]string, 0, len(flowStates))
+	for name := range flowStates {
+		flows = append(flows, name)
+	}
+	flowStatesLock.RUnlock()
+	sort.Strings(flows)
+
+	groups := make([]targetGroup, 0, len(flows))
+	for _, flow := range flows {
+		groups = append(groups, targetGroup{
+			Targets: []string{r.Host},
+			Labels: map[string]string{
+				"__metrics_path__": "/metrics",
+				"__param_flow":     flow,
+				"flow":             flow,
+			},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+func streamData(ctx context.Context, fp config.FlowProgram, state *flowState) error {
 	// initialize flow metrics
 	for _, mt := range fp.MetricTemplates {
 		flowMetricsReceived.WithLabelValues(fp.Name, mt.Stream)
 		flowMetricsFailed.WithLabelValues(fp.Name, mt.Stream)
 		flowMetricsFailed.WithLabelValues(fp.Name, mt.Stream)
 	}
+	for _, et := range fp.EventTemplates {
+		flowEventsReceived.WithLabelValues(fp.Name, et.Stream)
+		flowEventsFailed.WithLabelValues(fp.Name, et.Stream)
+	}
+	flowSeriesLimited.WithLabelValues(fp.Name)
+	flowRateLimited.WithLabelValues(fp.Name)
+	flowCircuitOpen.WithLabelValues(fp.Name)
+	flowGaveUp.WithLabelValues(fp.Name)
 
-	client, err := signalflow.NewClient(
-		signalflow.StreamURLForRealm(sfx.Realm),
-		signalflow.AccessToken(sfx.Token),
-	)
+	client, err := signalflow.NewClient(signalflowClientParams(fp)...)
 	if err != nil {
-		return fmt.Errorf("Error connecting to SignalFX realm %s - %+s", sfx.Realm, err)
+		return fmt.Errorf("Error connecting to SignalFX realm %s - %+s", fp.Realm(), err)
 	}
+	// closing the client ends the stream of a stopped flow
+	streamDone := make(chan struct{})
+	defer close(streamDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-streamDone:
+		}
+	}()
 
 	comp, err := client.Execute(&signalflow.ExecuteRequest{
-		Program: fp.Query,
-		Start:   time.Now().Add(fp.HistoricalData * -1),
+		Program:    fp.Query,
+		Start:      fp.StartTime(time.Now()),
+		Stop:       fp.Stop,
+		Resolution: fp.Resolution,
+		Immediate:  fp.Immediate,
 	})
 	if err != nil {
 		return fmt.Errorf("SignalFlow program for %s is invalid - %+s", fp.Name, err)
 	}
+	state.setState(flowStreaming)
+	go func() {
+		// both wait for the job info messages, so don't block the data stream
+		state.setJobTiming(comp.Resolution(), comp.MaxDelay())
+	}()
+
+	if len(fp.EventTemplates) > 0 {
+		go streamEvents(fp, comp)
+	}
 
 	for msg := range comp.Data() {
 		if len(msg.Payloads) == 0 {
 			continue
 		}
+		state.payloadReceived()
 		for _, pl := range msg.Payloads {
+			if !allowIngestion(fp.Name) {
+				continue
+			}
 			meta := comp.TSIDMetadata(pl.TSID)
+			if meta == nil {
+				// without metadata, not even the stream of the payload is known
+				flowMetricsFailed.WithLabelValues(fp.Name, streamUnknown).Inc()
+				continue
+			}
+			if fp.Shard != nil && !fp.Shard.Owns(shardKey(fp.Shard, pl.TSID, meta)) {
+				continue
+			}
 			stream, ok := meta.InternalProperties["sf_streamLabel"].(string)
 			if !ok {
 				stream = "default"
 			}
 			flowMetricsReceived.WithLabelValues(fp.Name, stream).Inc()
 			flowLastReceived.WithLabelValues(fp.Name, stream).SetToCurrentTime()
+			if fp.DebugSampleRate > 0 && sampleRand() < fp.DebugSampleRate {
+				Log().Debugf("flow %s sampled payload of stream %s: tsid=%s metric=%s dimensions=%v properties=%v value=%v timestamp=%d",
+					fp.Name, stream, pl.TSID, meta.OriginatingMetric, meta.CustomProperties, meta.InternalProperties, pl.Value(), msg.TimestampMillis)
+			}
 			mt, err := fp.GetMetricTemplateForStream(stream)
+			if errors.Is(err, config.ErrNoTemplate) {
+				// streams published without a template are not of interest
+				flowMetricsSkipped.WithLabelValues(fp.Name, stream, skippedUnmapped).Inc()
+				continue
+			}
 			if err != nil {
-				// todo log
+				Log().Errorf("flow %s failed to look up the template of stream %s: %+s", fp.Name, stream, err)
 				flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+				if state.payloadProcessed(true) {
+					client.Close()
+					return errCircuitOpen
+				}
 				continue
 			}
-
-			if mt.Type == "gauge" {
-				gauge, err := getGauge(mt, meta)
+			if meta.OriginatingMetric == "" && fp.DefaultMetricName == "" && mt.UsesSignalFxMetricName() {
+				flowMetricsSkipped.WithLabelValues(fp.Name, stream, skippedNoMetricName).Inc()
+				continue
+			}
+			if mt.When != "" {
+				matches, err := mt.Matches(buildTemplateVars(fp, meta), pl.Float64())
 				if err != nil {
 					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
-					// todo log
+					Log().Debugf("flow %s failed to evaluate the when predicate of stream %s: %+s", fp.Name, stream, err)
+					if state.payloadProcessed(true) {
+						client.Close()
+						return errCircuitOpen
+					}
+					continue
+				}
+				if !matches {
+					flowMetricsSkipped.WithLabelValues(fp.Name, stream, skippedPredicate).Inc()
+					continue
+				}
+			}
+
+			// dropping series on purpose is not a failure of the flow
+			failed := false
+			value := pl.Float64()
+			if mt.Transform != "" {
+				value, err = mt.TransformValue(buildTemplateVars(fp, meta), value)
+			}
+			if mt.Type != "counter" {
+				value = mt.ScaleValue(value)
+			}
+			if err != nil {
+				flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+				failed = true
+				Log().Debugf("flow %s failed to transform payload of stream %s: %+s", fp.Name, stream, err)
+			} else if mt.Type == "gauge" {
+				gauge, err := getGauge(fp, mt, pl.TSID, meta)
+				if err != nil || gauge == nil {
+					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+					failed = err != errSeriesRateLimited
+					if failed {
+						Log().Debugf("flow %s failed to update gauge of stream %s: %+s", fp.Name, stream, err)
+					}
 				} else {
-					gauge.Set(pl.Float64())
+					gaugeDecimator.Set(gauge, value, mt.MinUpdateInterval)
+					publishPayload(fp, mt, pl.TSID, meta, value, msg.TimestampMillis)
+					countSample(fp, mt, pl.TSID, meta)
 				}
 			} else if mt.Type == "counter" {
-				counter, err := getCounter(mt, meta)
+				counter, err := getCounter(fp, mt, pl.TSID, meta)
+				increment := value
+				if err == nil && counter == nil {
+					err = fmt.Errorf("no counter for stream %s", stream)
+				}
+				if err == nil && mt.Increment != "" {
+					increment, err = mt.GetIncrement(buildTemplateVars(fp, meta), value)
+				}
+				if err == nil && mt.Cumulative {
+					var series string
+					if series, err = counterSeriesKey(fp, mt, pl.TSID, meta); err == nil {
+						last, seen := sfxLastValues.swap(series, pl.TSID, value)
+						increment = cumulativeIncrement(last, seen, value, mt.InitialValue == config.InitialValueFirst)
+					}
+				}
+				if err == nil {
+					// transforms and resets of cumulative counters can go negative
+					increment = mt.ScaleIncrement(increment)
+					err = config.CheckIncrement(increment)
+				}
 				if err != nil {
 					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
-					// todo log
+					failed = err != errSeriesRateLimited
+					if failed {
+						Log().Debugf("flow %s failed to update counter of stream %s: %+s", fp.Name, stream, err)
+					}
 				} else {
-					counter.Add(pl.Float64())
+					counter.Add(increment)
+					if len(mt.AggregateWithout) > 0 {
+						if aggregate, err := getAggregateCounter(fp, mt, pl.TSID, meta); err != nil {
+							flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+							failed = true
+							Log().Debugf("flow %s failed to aggregate payload of stream %s: %+s", fp.Name, stream, err)
+						} else {
+							aggregate.Add(increment)
+						}
+					}
+					publishPayload(fp, mt, pl.TSID, meta, mt.ScaleIncrement(value), msg.TimestampMillis)
+					countSample(fp, mt, pl.TSID, meta)
 				}
+			} else if mt.Type == "histogram" {
+				histogram, err := getHistogram(fp, mt, pl.TSID, meta)
+				if err != nil || histogram == nil {
+					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+					failed = err != errSeriesRateLimited
+					Log().Debugf("flow %s failed to observe payload of stream %s in a histogram: %+s", fp.Name, stream, err)
+				} else {
+					histogram.Observe(value)
+					publishPayload(fp, mt, pl.TSID, meta, value, msg.TimestampMillis)
+					countSample(fp, mt, pl.TSID, meta)
+				}
+			} else if mt.Type == "summary" {
+				summary, err := getSummary(fp, mt, pl.TSID, meta)
+				if err != nil || summary == nil {
+					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+					failed = err != errSeriesRateLimited
+					Log().Debugf("flow %s failed to observe payload of stream %s in a summary: %+s", fp.Name, stream, err)
+				} else {
+					summary.Observe(value)
+					publishPayload(fp, mt, pl.TSID, meta, value, msg.TimestampMillis)
+					countSample(fp, mt, pl.TSID, meta)
+				}
+			}
+			if state.payloadProcessed(failed) {
+				client.Close()
+				return errCircuitOpen
 			}
 		}
 	}
 
 	/* signalflow programs without stop timestamp should run forever. if the
 	above loop exists, it implies that the program exited. if comp.Err() is
-	not set, we have to assume an unknown error */
+	not set, the connection dropped */
 	err = comp.Err()
+	if err == nil && !fp.Stop.IsZero() {
+		/* bounded programs end once their stop timestamp is reached. the
+		series they produced are final and expire together with the program */
+		reapFlowSeries(fp.Name)
+		state.setState(flowFinished)
+		client.Close()
+		return nil
+	}
 	if err == nil {
-		err = errors.New("flow failed for an unknown reason")
+		err = errStreamClosed
 	}
 	client.Close()
 	return err
 }
 
-func buildPrometheusMetadata(metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) (string, []string, []string, error) {
-	// data for template rendering
-	safeMetricName := strings.ReplaceAll(sfxMeta.OriginatingMetric, ".", "_")
-	safeMetricName = strings.ReplaceAll(safeMetricName, ":", "_")
-	templateVars := config.NameTemplateVars{
+func publishPayload(fp config.FlowProgram, mt config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties, value float64, timestampMs uint64) {
+	if kafkaSink == nil {
+		return
+	}
+	if err := kafkaSink.Publish(fp, mt, tsid, sfxMeta, value, timestampMs); err != nil {
+		Log().Errorf("Flow %s failed to publish payload to kafka: %+s", fp.Name, err)
+	}
+}
+
+func streamEvents(fp config.FlowProgram, comp *signalflow.Computation) {
+	/* the signalflow client does not offer a channel for events, it collects
+	them on the computation instead. poll them until the computation ends and
+	only process the ones that have not been seen yet */
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	processed := 0
+	for {
+		select {
+		case <-comp.Done():
+			return
+		case <-ticker.C:
+			events := comp.Events()
+			for _, ev := range events[processed:] {
+				meta := eventMetadata(ev)
+				stream, ok := meta.InternalProperties["sf_streamLabel"].(string)
+				if !ok {
+					stream = "default"
+				}
+				flowEventsReceived.WithLabelValues(fp.Name, stream).Inc()
+				et, err := fp.GetEventTemplateForStream(stream)
+				if err != nil {
+					flowEventsFailed.WithLabelValues(fp.Name, stream).Inc()
+					continue
+				}
+				// events have no TSID, their metadata differs for every event
+				counter, err := getCounter(fp, et, 0, meta)
+				if err != nil {
+					flowEventsFailed.WithLabelValues(fp.Name, stream).Inc()
+					Log().Debugf("flow %s failed to count event of stream %s: %+s", fp.Name, stream, err)
+				} else {
+					counter.Inc()
+				}
+			}
+			processed = len(events)
+		}
+	}
+}
+
+func eventMetadata(ev *messages.EventMessage) *messages.MetadataProperties {
+	// translate event metadata and properties so metric templates can be applied
+	meta := &messages.MetadataProperties{
+		InternalProperties: make(map[string]interface{}),
+		CustomProperties:   make(map[string]string),
+	}
+	raw := ev.RawData()
+	for _, section := range []string{"metadata", "properties"} {
+		props, ok := raw[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range props {
+			if strings.HasPrefix(k, "sf_") {
+				meta.InternalProperties[k] = v
+			} else {
+				meta.CustomProperties[k] = propertyString(v)
+			}
+		}
+	}
+	if eventType, ok := meta.InternalProperties["sf_eventType"].(string); ok {
+		meta.OriginatingMetric = eventType
+	}
+	return meta
+}
+
+// buildTemplateVars prepares the SignalFX metadata for template rendering
+func buildTemplateVars(fp config.FlowProgram, sfxMeta *messages.MetadataProperties) config.NameTemplateVars {
+	if sfxMeta == nil {
+		sfxMeta = &messages.MetadataProperties{}
+	}
+	metricName := sfxMeta.OriginatingMetric
+	if metricName == "" {
+		// computed streams don't always have an originating metric
+		metricName = fp.DefaultMetricName
+	}
+	// colons are valid, but reserved for recording rules
+	safeMetricName := SanitizeMetricName(strings.ReplaceAll(metricName, ":", "_"))
+	internalProperties := make(map[string]string, len(sfxMeta.InternalProperties))
+	for k, v := range sfxMeta.InternalProperties {
+		internalProperties[k] = propertyString(v)
+	}
+	return config.NameTemplateVars{
 		SignalFxMetricName: safeMetricName,
-		SignalFxLabels:     sfxMeta.CustomProperties,
+		SignalFxLabels:     coerceCustomProperties(sfxMeta.CustomProperties),
+		SignalFxInternal:   internalProperties,
 	}
+}
 
-	// build name
-	name, err := metric.GetMetricName(templateVars)
-	if err != nil {
-		return "", nil, nil, err
+func buildPrometheusMetadata(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (string, []string, []string, error) {
+	if sfxMeta == nil {
+		return "", nil, nil, errNoMetadata
 	}
+	templateVars := buildTemplateVars(fp, sfxMeta)
 
-	// build labels
-	labelNames := make([]string, len(metric.Labels))
-	labelValues := make([]string, len(metric.Labels))
-	var i = 0
+	// build name, the name mapping file takes precedence over the template
+	name, ok := sfxNameMapping.lookup(sfxMeta.OriginatingMetric)
+	if !ok {
+		var err error
+		name, err = metric.GetMetricName(templateVars)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	// registering an invalid name would panic
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return "", nil, nil, fmt.Errorf("Rendered metric name %q in flow %s is not a valid Prometheus metric name", name, fp.Name)
+	}
+
+	// build labels in a stable order, so label values always line up with
+	// the label names of an already registered metric
+	labelCount := len(metric.Labels) + len(fp.StaticLabels) + 3
+	labelNames := make([]string, 0, labelCount)
 	for name := range metric.Labels {
-		labelNames[i] = name
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	labelValues := make([]string, len(labelNames), labelCount)
+	for i, name := range labelNames {
 		value, err := metric.GetLabelValue(name, templateVars)
 		if err != nil {
-			return "", nil, nil, err
+			// an empty value drops the label, like for a missing dimension
+			switch fp.LabelErrors {
+			case config.LabelErrorsFallback:
+				value = fp.LabelFallback
+			case config.LabelErrorsDrop:
+				value = ""
+			default:
+				return "", nil, nil, err
+			}
+			Log().Debugf("label %s of flow %s failed to render, falling back to %q: %+s", name, fp.Name, value, err)
+			labelFallbacks.WithLabelValues(fp.Name, name).Inc()
 		}
 		labelValues[i] = value
-		i++
+	}
+	staticNames := make([]string, 0, len(fp.StaticLabels))
+	for name := range fp.StaticLabels {
+		staticNames = append(staticNames, name)
+	}
+	sort.Strings(staticNames)
+	for _, name := range staticNames {
+		labelNames = append(labelNames, name)
+		labelValues = append(labelValues, fp.StaticLabels[name])
+	}
+	if fp.HasFlowLabel() {
+		labelNames = append(labelNames, config.FlowLabelName)
+		labelValues = append(labelValues, fp.Name)
+	}
+	if fp.RealmLabel != "" {
+		labelNames = append(labelNames, fp.RealmLabel)
+		labelValues = append(labelValues, fp.Realm())
+	}
+	if fp.TSIDLabel != "" {
+		// events have no TSID
+		tsidValue := ""
+		if tsid != 0 {
+			tsidValue = tsid.String()
+		}
+		labelNames = append(labelNames, fp.TSIDLabel)
+		labelValues = append(labelValues, tsidValue)
+	}
+	for _, labelName := range labelNames {
+		if !model.LabelName(labelName).IsValid() {
+			return "", nil, nil, fmt.Errorf("Label %q of metric %s in flow %s is not a valid Prometheus label name", labelName, name, fp.Name)
+		}
 	}
 
 	return name, labelNames, labelValues, nil
 }
 
-func getGauge(metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) (prometheus.Gauge, error) {
-	name, labelNames, labelValues, err := buildPrometheusMetadata(metric, sfxMeta)
+// shardKey is the value a series is assigned to a shard by
+func shardKey(shard *config.Shard, tsid idtool.ID, sfxMeta *messages.MetadataProperties) string {
+	if shard.Key == "" {
+		return tsid.String()
+	}
+	if sfxMeta == nil {
+		return ""
+	}
+	return sfxMeta.CustomProperties[shard.Key]
+}
+
+func reapFlowSeries(flow string) {
+	sfxLabels.removeFlow(flow)
+	deleteSeries(sfxSeries.removeFlow(flow))
+}
+
+// reapStaleSeries frees the series that are stale at now and returns how many
+func reapStaleSeries(now time.Time) int {
+	stale := sfxSeries.removeStale(now)
+	if len(stale) > 0 {
+		sfxLabels.removeSeries(stale)
+	}
+	deleteSeries(stale)
+	return len(stale)
+}
+
+// deleteSeries removes untracked series from the sfxRegistry
+func deleteSeries(series []*trackedSeries) {
+	sfxMetricsLock.RLock()
+	defer sfxMetricsLock.RUnlock()
+	for _, s := range series {
+		if g, ok := sfxGauges[s.name]; ok {
+			if child, err := g.GetMetricWithLabelValues(s.labelValues...); err == nil {
+				gaugeDecimator.Forget(child)
+			}
+			g.DeleteLabelValues(s.labelValues...)
+		}
+		if c, ok := sfxCounters[s.name]; ok {
+			sfxLastValues.delete(seriesKey(s.name, s.labelValues))
+			c.DeleteLabelValues(s.labelValues...)
+		}
+		if h, ok := sfxHistograms[s.name]; ok {
+			h.DeleteLabelValues(s.labelValues...)
+		}
+		if sm, ok := sfxSummaries[s.name]; ok {
+			sm.DeleteLabelValues(s.labelValues...)
+		}
+		sfxMetadata.delete(s.name, s.labelValues)
+	}
+}
+
+// counterName is the name of a counter, with the _total suffix if the flow asks for it
+func counterName(fp config.FlowProgram, name string) string {
+	if fp.HasCounterTotalSuffix() && !strings.HasSuffix(name, "_total") {
+		return name + "_total"
+	}
+	return name
+}
+
+// countSample counts a processed payload by the metric it updated, for flows with countSamples
+func countSample(fp config.FlowProgram, mt config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) {
+	if !fp.CountSamples {
+		return
+	}
+	name, _, _, err := sfxLabels.render(fp, mt, tsid, sfxMeta)
 	if err != nil {
-		return nil, nil
+		return
+	}
+	if mt.Type == "counter" {
+		name = counterName(fp, name)
 	}
+	metricSamples.WithLabelValues(fp.Name, name).Inc()
+}
 
-	// build  or reuse gauge
-	g, ok := sfxGauges[name]
-	if !ok {
-		g = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: name,
-		}, labelNames)
-		sfxGauges[name] = g
-		sfxRegistry.MustRegister(g)
+// aggregateName is the name of the counter summing a counter without some labels
+func aggregateName(name string) string {
+	if strings.HasSuffix(name, "_total") {
+		return strings.TrimSuffix(name, "_total") + "_aggregate_total"
 	}
-	return g.WithLabelValues(labelValues...), nil
+	return name + "_aggregate"
 }
 
-func getCounter(metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) (prometheus.Counter, error) {
-	name, labelNames, labelValues, err := buildPrometheusMetadata(metric, sfxMeta)
+// getAggregateCounter returns the counter a counter is summed up in without
+// the labels listed in aggregateWithout, like a precomputed sum without(...).
+func getAggregateCounter(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (prometheus.Counter, error) {
+	name, labelNames, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
+	name = counterName(fp, name)
+	name = aggregateName(name)
 
-	// build  or reuse gauge
+	without := make(map[string]bool, len(metric.AggregateWithout))
+	for _, label := range metric.AggregateWithout {
+		without[label] = true
+	}
+	aggregateLabelNames := make([]string, 0, len(labelNames))
+	aggregateLabelValues := make([]string, 0, len(labelValues))
+	for i, label := range labelNames {
+		if !without[label] {
+			aggregateLabelNames = append(aggregateLabelNames, label)
+			aggregateLabelValues = append(aggregateLabelValues, labelValues[i])
+		}
+	}
+
+	c, _, err := counterVec(fp, name, metricHelp(fp, metric, sfxMeta), aggregateLabelNames)
+	if err != nil {
+		return nil, err
+	}
+	sfxSeries.touch(fp.Name, name, aggregateLabelNames, aggregateLabelValues, metric.StaleAfter)
+	return c.GetMetricWithLabelValues(aggregateLabelValues...)
+}
+
+// allowIngestion applies the ingestion rate limits of the flow and the global
+// one to a payload. limiting is logged once it starts and once no payload was
+// dropped for a while, instead of for every dropped payload.
+func allowIngestion(flow string) bool {
+	flowLimitersLock.RLock()
+	limiter, ok := ingestionLimiters[flow]
+	flowLimitersLock.RUnlock()
+	allowed := (!ok || limiter.Allow()) && (globalIngestionLimiter == nil || globalIngestionLimiter.Allow())
+
+	ingestionLimitedLock.Lock()
+	defer ingestionLimitedLock.Unlock()
+	lastDropped, limited := ingestionLimited[flow]
+	if allowed {
+		if limited && time.Since(lastDropped) > ingestionLimitQuietPeriod {
+			Log().Infof("Ingestion rate limit for flow %s disengaged", flow)
+			delete(ingestionLimited, flow)
+		}
+		return true
+	}
+	if !limited {
+		Log().Warnf("Ingestion rate limit for flow %s engaged, dropping payloads", flow)
+	}
+	ingestionLimited[flow] = time.Now()
+	flowRateLimited.WithLabelValues(flow).Inc()
+	return false
+}
+
+func checkSeriesLimit(fp config.FlowProgram, name string, labelValues []string) error {
+	flowLimitersLock.RLock()
+	limiter, ok := seriesLimiters[fp.Name]
+	flowLimitersLock.RUnlock()
+	if !ok || sfxSeries.known(name, labelValues) {
+		return nil
+	}
+
+	allowed := limiter.Allow()
+	seriesLimiterEngagedLock.Lock()
+	defer seriesLimiterEngagedLock.Unlock()
+	if allowed {
+		if seriesLimiterEngaged[fp.Name] {
+			Log().Infof("Series registration rate limit for flow %s disengaged", fp.Name)
+			seriesLimiterEngaged[fp.Name] = false
+		}
+		return nil
+	}
+	if !seriesLimiterEngaged[fp.Name] {
+		Log().Warnf("Series registration rate limit for flow %s engaged, dropping new series", fp.Name)
+		seriesLimiterEngaged[fp.Name] = true
+	}
+	flowSeriesLimited.WithLabelValues(fp.Name).Inc()
+	return errSeriesRateLimited
+}
+
+// gaugeVec builds or reuses the gauge vector of a metric name, help is only
+// called to build it.
+//
+// flows register their metrics concurrently, so the lookup is repeated under the
+// write lock before a new vector is registered, otherwise two flows could race
+// to register the same name. names that are taken by a metric of another type
+// or with other label names fail instead of panicking.
+func gaugeVec(fp config.FlowProgram, name string, help func() string, labelNames []string) (*prometheus.GaugeVec, error) {
+	sfxMetricsLock.RLock()
+	g, ok := sfxGauges[name]
+	owned := sfxMetricFlows[name][fp.Name]
+	sfxMetricsLock.RUnlock()
+	if ok && owned {
+		return g, checkLabelNames(fp, name, labelNames)
+	}
+
+	sfxMetricsLock.Lock()
+	defer sfxMetricsLock.Unlock()
+	if g, ok := sfxGauges[name]; ok {
+		return g, useVecLocked(fp, name, labelNames)
+	}
+	g = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: name,
+		Help: help(),
+	}, labelNames)
+	if err := registerVec(fp, name, labelNames); err != nil {
+		return nil, err
+	}
+	sfxGauges[name] = g
+	return g, nil
+}
+
+// counterVec builds or reuses the counter vector of a metric name like
+// gaugeVec, and tells whether it was built
+func counterVec(fp config.FlowProgram, name string, help func() string, labelNames []string) (*prometheus.CounterVec, bool, error) {
+	sfxMetricsLock.RLock()
 	c, ok := sfxCounters[name]
-	if !ok {
-		c = prometheus.NewCounterVec(prometheus.CounterOpts{
-			Name: name,
-		}, labelNames)
-		sfxCounters[name] = c
-		sfxRegistry.MustRegister(c)
+	owned := sfxMetricFlows[name][fp.Name]
+	sfxMetricsLock.RUnlock()
+	if ok && owned {
+		return c, false, checkLabelNames(fp, name, labelNames)
+	}
+
+	sfxMetricsLock.Lock()
+	defer sfxMetricsLock.Unlock()
+	if c, ok := sfxCounters[name]; ok {
+		return c, false, useVecLocked(fp, name, labelNames)
+	}
+	c = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help(),
+	}, labelNames)
+	if err := registerVec(fp, name, labelNames); err != nil {
+		return nil, false, err
+	}
+	sfxCounters[name] = c
+	return c, true, nil
+}
+
+// histogramVec builds or reuses the histogram vector of a metric name like gaugeVec
+func histogramVec(fp config.FlowProgram, name string, help func() string, labelNames []string, buckets []float64) (*prometheus.HistogramVec, error) {
+	sfxMetricsLock.RLock()
+	h, ok := sfxHistograms[name]
+	owned := sfxMetricFlows[name][fp.Name]
+	sfxMetricsLock.RUnlock()
+	if ok && owned {
+		return h, checkLabelNames(fp, name, labelNames)
+	}
+
+	sfxMetricsLock.Lock()
+	defer sfxMetricsLock.Unlock()
+	if h, ok := sfxHistograms[name]; ok {
+		return h, useVecLocked(fp, name, labelNames)
+	}
+	h = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help(),
+		Buckets: buckets,
+	}, labelNames)
+	if err := registerVec(fp, name, labelNames); err != nil {
+		return nil, err
+	}
+	sfxHistograms[name] = h
+	return h, nil
+}
+
+// summaryVec builds or reuses the summary vector of a metric name like gaugeVec
+func summaryVec(fp config.FlowProgram, name string, help func() string, labelNames []string, objectives map[float64]float64, maxAge time.Duration) (*prometheus.SummaryVec, error) {
+	sfxMetricsLock.RLock()
+	sm, ok := sfxSummaries[name]
+	owned := sfxMetricFlows[name][fp.Name]
+	sfxMetricsLock.RUnlock()
+	if ok && owned {
+		return sm, checkLabelNames(fp, name, labelNames)
+	}
+
+	sfxMetricsLock.Lock()
+	defer sfxMetricsLock.Unlock()
+	if sm, ok := sfxSummaries[name]; ok {
+		return sm, useVecLocked(fp, name, labelNames)
+	}
+	sm = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       name,
+		Help:       help(),
+		Objectives: objectives,
+		MaxAge:     maxAge,
+	}, labelNames)
+	if err := registerVec(fp, name, labelNames); err != nil {
+		return nil, err
+	}
+	sfxSummaries[name] = sm
+	return sm, nil
+}
+
+// registerVec records the label names of a new vector of a metric name, which
+// fails if the name is taken by a metric of another type. sfxMetricsLock must be
+// held for writing.
+func registerVec(fp config.FlowProgram, name string, labelNames []string) error {
+	if _, ok := sfxLabelNames[name]; ok {
+		return fmt.Errorf("Metric %s of flow %s is already registered with another type", name, fp.Name)
+	}
+	sfxLabelNames[name] = labelNames
+	sfxMetricFlows[name] = map[string]bool{fp.Name: true}
+	if fp.DropEmptyLabels {
+		compactedMetrics.Store(name, true)
+	}
+	return nil
+}
+
+// useVecLocked records a flow as a user of the registered vector of a metric
+// name, as long as it asks for the same label names. sfxMetricsLock must be
+// held for writing.
+func useVecLocked(fp config.FlowProgram, name string, labelNames []string) error {
+	if err := checkLabelNamesLocked(fp, name, labelNames); err != nil {
+		return err
+	}
+	sfxMetricFlows[name][fp.Name] = true
+	return nil
+}
+
+// unregisterFlowMetrics drops the vectors that no flow but the stopped one
+// used, so a restarted flow can register them again with other label names or
+// another type
+func unregisterFlowMetrics(flow string) {
+	sfxMetricsLock.Lock()
+	defer sfxMetricsLock.Unlock()
+	for name, flows := range sfxMetricFlows {
+		if !flows[flow] {
+			continue
+		}
+		delete(flows, flow)
+		if len(flows) > 0 {
+			continue
+		}
+		delete(sfxGauges, name)
+		delete(sfxCounters, name)
+		delete(sfxHistograms, name)
+		delete(sfxSummaries, name)
+		delete(sfxMetricFlows, name)
+		delete(sfxLabelNames, name)
+		compactedMetrics.Delete(name)
+	}
+}
+
+// checkLabelNames fails for label names that differ from the ones the vector
+// of a metric name was built with, which would panic once used
+func checkLabelNames(fp config.FlowProgram, name string, labelNames []string) error {
+	sfxMetricsLock.RLock()
+	defer sfxMetricsLock.RUnlock()
+	return checkLabelNamesLocked(fp, name, labelNames)
+}
+
+func checkLabelNamesLocked(fp config.FlowProgram, name string, labelNames []string) error {
+	registered := sfxLabelNames[name]
+	if len(registered) != len(labelNames) {
+		return fmt.Errorf("Metric %s of flow %s has labels %v, but is registered with %v", name, fp.Name, labelNames, registered)
+	}
+	for i := range registered {
+		if registered[i] != labelNames[i] {
+			return fmt.Errorf("Metric %s of flow %s has labels %v, but is registered with %v", name, fp.Name, labelNames, registered)
+		}
+	}
+	return nil
+}
+
+// metricHelp renders the help of a metric lazily, as it is only needed once
+// the vector of the metric is built
+func metricHelp(fp config.FlowProgram, metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) func() string {
+	return func() string {
+		help, err := metric.GetHelp(buildTemplateVars(fp, sfxMeta))
+		if err != nil {
+			Log().Warnf("failed to render the help of a metric of flow %s, using the default: %+s", fp.Name, err)
+			return config.DefaultHelp
+		}
+		return help
+	}
+}
+
+func getGauge(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (prometheus.Gauge, error) {
+	name, labelNames, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSeriesLimit(fp, name, labelValues); err != nil {
+		return nil, err
+	}
+
+	g, err := gaugeVec(fp, name, metricHelp(fp, metric, sfxMeta), labelNames)
+	if err != nil {
+		return nil, err
+	}
+	sfxSeries.touch(fp.Name, name, labelNames, labelValues, metric.StaleAfter)
+	if metric.ExportMetadata {
+		if err := sfxMetadata.set(name, labelNames, labelValues, metadataDimensions(fp, sfxMeta)); err != nil {
+			return nil, err
+		}
+	}
+	return g.GetMetricWithLabelValues(labelValues...)
+}
+
+// counterSeriesKey is the seriesKey of the counter a time series writes to
+func counterSeriesKey(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (string, error) {
+	name, _, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return "", err
+	}
+	return seriesKey(counterName(fp, name), labelValues), nil
+}
+
+func getCounter(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (prometheus.Counter, error) {
+	name, labelNames, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return nil, err
+	}
+	name = counterName(fp, name)
+
+	if err := checkSeriesLimit(fp, name, labelValues); err != nil {
+		return nil, err
+	}
+
+	c, created, err := counterVec(fp, name, metricHelp(fp, metric, sfxMeta), labelNames)
+	if err != nil {
+		return nil, err
+	}
+	if created && !strings.HasSuffix(name, "_total") {
+		Log().Warnf("Counter %s of flow %s lacks the _total suffix, consider enabling counterTotalSuffix", name, fp.Name)
+	}
+	sfxSeries.touch(fp.Name, name, labelNames, labelValues, metric.StaleAfter)
+	if metric.ExportMetadata {
+		if err := sfxMetadata.set(name, labelNames, labelValues, metadataDimensions(fp, sfxMeta)); err != nil {
+			return nil, err
+		}
+	}
+	return c.GetMetricWithLabelValues(labelValues...)
+}
+
+func getHistogram(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (prometheus.Observer, error) {
+	name, labelNames, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSeriesLimit(fp, name, labelValues); err != nil {
+		return nil, err
+	}
+
+	h, err := histogramVec(fp, name, metricHelp(fp, metric, sfxMeta), labelNames, metric.Buckets)
+	if err != nil {
+		return nil, err
+	}
+	sfxSeries.touch(fp.Name, name, labelNames, labelValues, metric.StaleAfter)
+	if metric.ExportMetadata {
+		if err := sfxMetadata.set(name, labelNames, labelValues, metadataDimensions(fp, sfxMeta)); err != nil {
+			return nil, err
+		}
+	}
+	return h.GetMetricWithLabelValues(labelValues...)
+}
+
+func getSummary(fp config.FlowProgram, metric config.PrometheusMetric, tsid idtool.ID, sfxMeta *messages.MetadataProperties) (prometheus.Observer, error) {
+	name, labelNames, labelValues, err := sfxLabels.render(fp, metric, tsid, sfxMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSeriesLimit(fp, name, labelValues); err != nil {
+		return nil, err
+	}
+
+	sm, err := summaryVec(fp, name, metricHelp(fp, metric, sfxMeta), labelNames, metric.Objectives, metric.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	sfxSeries.touch(fp.Name, name, labelNames, labelValues, metric.StaleAfter)
+	if metric.ExportMetadata {
+		if err := sfxMetadata.set(name, labelNames, labelValues, metadataDimensions(fp, sfxMeta)); err != nil {
+			return nil, err
+		}
 	}
-	return c.WithLabelValues(labelValues...), nil
+	return sm.GetMetricWithLabelValues(labelValues...)
 }
@@ -0,0 +1,1793 @@
+package serve
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	setupObservabilityMetrics()
+	os.Exit(m.Run())
+}
+
+// startFakeBackend runs a SignalFlow backend that serves a single time series
+// for the given program and points the signalflow client to it
+func startFakeBackend(t *testing.T, program string, props *messages.MetadataProperties, value float64) *signalflow.FakeBackend {
+	backend := signalflow.NewRunningFakeBackend()
+	t.Cleanup(backend.Stop)
+
+	tsid := idtool.ID(1)
+	backend.AddProgramTSIDs(program, []idtool.ID{tsid})
+	backend.AddTSIDMetadata(tsid, props)
+	backend.SetTSIDFloatData(tsid, value)
+
+	defaultClientParams := signalflowClientParams
+	signalflowClientParams = func(fp config.FlowProgram) []signalflow.ClientParam {
+		return []signalflow.ClientParam{
+			signalflow.StreamURL(backend.URL()),
+			signalflow.AccessToken(backend.AccessToken),
+		}
+	}
+	t.Cleanup(func() { signalflowClientParams = defaultClientParams })
+	return backend
+}
+
+func loadFlow(t *testing.T, configFile string) config.FlowProgram {
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	return cfg.Flows[0]
+}
+
+func TestFiniteFlowReapsSeries(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: finite
+  query: data('finite.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric: "finite.metric",
+		ResolutionMS:      10,
+		CustomProperties:  map[string]string{"host": "a"},
+	}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+
+	state := newFlowState(fp.Name, "", 0, 0)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+
+	assert.Greater(t, testutil.ToFloat64(flowMetricsReceived.WithLabelValues(fp.Name, "default")), 0.0)
+	assert.Contains(t, sfxGauges, "finite_metric")
+	assert.Equal(t, 0, testutil.CollectAndCount(sfxGauges["finite_metric"]))
+	assert.Equal(t, 0, sfxSeries.countForFlow(fp.Name))
+	assert.Equal(t, flowFinished, state.status().State)
+}
+
+func TestStalenessHonorsMaxDelay(t *testing.T) {
+	state := newFlowState("delayed", "", 0, 0)
+	state.setState(flowStreaming)
+	state.setJobTiming(time.Second, 2*time.Minute)
+
+	state.lastPayload = time.Now().Add(-30 * time.Second)
+	assert.False(t, state.status().Stale)
+	assert.Equal(t, "2m1s", state.status().StaleAfter)
+
+	state.lastPayload = time.Now().Add(-5 * time.Minute)
+	assert.True(t, state.status().Stale)
+}
+
+func TestStalenessThresholdOverride(t *testing.T) {
+	state := newFlowState("overridden", "", 10*time.Second, 0)
+	state.setState(flowStreaming)
+	state.setJobTiming(time.Second, 2*time.Minute)
+
+	state.lastPayload = time.Now().Add(-30 * time.Second)
+	assert.True(t, state.status().Stale)
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	state := newFlowState("breaking", "", 0, 3)
+	state.setState(flowStreaming)
+
+	assert.False(t, state.payloadProcessed(true))
+	assert.False(t, state.payloadProcessed(true))
+	// a success resets the consecutive failures
+	assert.False(t, state.payloadProcessed(false))
+	assert.False(t, state.payloadProcessed(true))
+	assert.False(t, state.payloadProcessed(true))
+	assert.True(t, state.payloadProcessed(true))
+	assert.Equal(t, flowDisabled, state.status().State)
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowCircuitOpen.WithLabelValues("breaking")))
+
+	assert.True(t, state.resumeFlow())
+	assert.True(t, state.waitForResume(context.Background()))
+	assert.False(t, state.resumeFlow())
+	assert.Equal(t, 0.0, testutil.ToFloat64(flowCircuitOpen.WithLabelValues("breaking")))
+}
+
+func TestCircuitBreakerDisabledByDefault(t *testing.T) {
+	state := newFlowState("unbreakable", "", 0, 0)
+	for i := 0; i < 100; i++ {
+		assert.False(t, state.payloadProcessed(true))
+	}
+}
+
+func TestExportMetadata(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: metadata
+  query: data('meta.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    exportMetadata: true
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	meta := &messages.MetadataProperties{
+		OriginatingMetric: "meta.metric",
+		CustomProperties:  map[string]string{"host": "a", "team": "core", "aws.region": "eu", "__id": "x"},
+	}
+	_, err := getGauge(fp, mt, 1, meta)
+	assert.Nil(t, err)
+
+	expected := `
+# HELP meta_metric_meta SignalFX metadata of meta_metric
+# TYPE meta_metric_meta gauge
+meta_metric_meta{_id="x",aws_region="eu",host="a",team="core"} 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(sfxRegistry, strings.NewReader(expected), "meta_metric_meta"))
+
+	reapFlowSeries(fp.Name)
+	assert.Nil(t, testutil.GatherAndCompare(sfxRegistry, strings.NewReader(""), "meta_metric_meta"))
+}
+
+func TestLabelCacheKeysByStream(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: streams
+  query: |
+    data('shared.metric').publish('a')
+    data('shared.metric').publish('b')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+    name: stream_a_metric
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+  - type: gauge
+    stream: b
+    name: stream_b_metric
+    labels:
+      team: '{{ .SignalFxLabels.team }}'
+`)
+	cache := newLabelCache()
+	meta := &messages.MetadataProperties{
+		OriginatingMetric: "shared.metric",
+		CustomProperties:  map[string]string{"host": "a", "team": "core"},
+	}
+	mtA, _ := fp.GetMetricTemplateForStream("a")
+	mtB, _ := fp.GetMetricTemplateForStream("b")
+
+	for i := 0; i < 2; i++ {
+		name, labelNames, labelValues, err := cache.render(fp, mtA, 1, meta)
+		assert.Nil(t, err)
+		assert.Equal(t, "stream_a_metric", name)
+		assert.Equal(t, []string{"host"}, labelNames)
+		assert.Equal(t, []string{"a"}, labelValues)
+
+		name, labelNames, labelValues, err = cache.render(fp, mtB, 1, meta)
+		assert.Nil(t, err)
+		assert.Equal(t, "stream_b_metric", name)
+		assert.Equal(t, []string{"team"}, labelNames)
+		assert.Equal(t, []string{"core"}, labelValues)
+	}
+
+	// updated metadata of a TSID is rendered again
+	updated := &messages.MetadataProperties{
+		OriginatingMetric: "shared.metric",
+		CustomProperties:  map[string]string{"host": "b", "team": "core"},
+	}
+	_, _, labelValues, err := cache.render(fp, mtA, 1, updated)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b"}, labelValues)
+}
+
+func TestCumulativeIncrement(t *testing.T) {
+	assert.Equal(t, 0.0, cumulativeIncrement(0, false, 100, false))
+	assert.Equal(t, 100.0, cumulativeIncrement(0, false, 100, true))
+	assert.Equal(t, 5.0, cumulativeIncrement(100, true, 105, false))
+	// the source counter was reset
+	assert.Equal(t, 3.0, cumulativeIncrement(105, true, 3, false))
+}
+
+func TestLastValueStore(t *testing.T) {
+	store := newLastValueStore()
+	_, ok := store.get("a", 1)
+	assert.False(t, ok)
+
+	store.set("a", 1, 10)
+	store.set("a", 2, 20)
+	last, ok := store.swap("a", 1, 15)
+	assert.True(t, ok)
+	assert.Equal(t, 10.0, last)
+	value, _ := store.get("a", 2)
+	assert.Equal(t, 20.0, value)
+
+	// deleting a series forgets all its time series
+	store.delete("a")
+	_, ok = store.get("a", 1)
+	assert.False(t, ok)
+	_, ok = store.get("a", 2)
+	assert.False(t, ok)
+}
+
+func TestLastValueStoreConcurrentIncrements(t *testing.T) {
+	store := newLastValueStore()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sums := make(map[idtool.ID]float64)
+	for tsid := idtool.ID(1); tsid <= 4; tsid++ {
+		for worker := 0; worker < 2; worker++ {
+			wg.Add(1)
+			go func(tsid idtool.ID) {
+				defer wg.Done()
+				sum := 0.0
+				for total := 1.0; total <= 100; total++ {
+					last, seen := store.swap("shared", tsid, total)
+					sum += cumulativeIncrement(last, seen, total, true)
+				}
+				mu.Lock()
+				sums[tsid] += sum
+				mu.Unlock()
+			}(tsid)
+		}
+	}
+	wg.Wait()
+	// interleaved totals look like resets, but each swap sees a distinct
+	// previous value, so no increment is lost and at least the final total
+	// is counted per time series
+	for tsid, sum := range sums {
+		assert.GreaterOrEqual(t, sum, 100.0, tsid)
+	}
+}
+
+func TestCumulativeCountersPerTimeSeries(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: cumulative-shared
+  query: data('shared.requests').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    name: shared_requests_total
+    cumulative: true
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	meta := &messages.MetadataProperties{OriginatingMetric: "shared.requests"}
+	_, err := getCounter(fp, mt, 1, meta)
+	assert.Nil(t, err)
+	series, err := counterSeriesKey(fp, mt, 1, meta)
+	assert.Nil(t, err)
+
+	// two time series without distinguishing labels write to one counter,
+	// each with its own running total
+	increments := 0.0
+	for _, total := range []struct {
+		tsid  idtool.ID
+		value float64
+	}{{1, 100}, {2, 5}, {1, 110}, {2, 8}} {
+		last, seen := sfxLastValues.swap(series, total.tsid, total.value)
+		increments += cumulativeIncrement(last, seen, total.value, false)
+	}
+	assert.Equal(t, 13.0, increments)
+
+	// the last values go along with the series
+	reapFlowSeries(fp.Name)
+	_, ok := sfxLastValues.get(series, 1)
+	assert.False(t, ok)
+}
+
+func TestNegativeCounterIncrementsFail(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: negative
+  query: data('negative.requests').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    name: negative_requests_total
+    transform: '{{ sub .Value 100 }}'
+    aggregateWithout: [host]
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	defer reapFlowSeries(fp.Name)
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric: "negative.requests",
+		ResolutionMS:      10,
+		CustomProperties:  map[string]string{"host": "a"},
+	}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+
+	// a negative increment would make the counter panic
+	state := newFlowState(fp.Name, "", 0, 0)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+	assert.Greater(t, testutil.ToFloat64(flowMetricsFailed.WithLabelValues(fp.Name, "default")), 0.0)
+	assert.Equal(t, 0.0, testutil.ToFloat64(sfxCounters["negative_requests_total"].WithLabelValues("a")))
+}
+
+func TestTargetsAndFlowScrapes(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: targeted
+  query: data('targeted.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+      zone: '{{ .SignalFxLabels.zone }}'
+`)
+	newFlowState(fp.Name, "", 0, 0)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	gauge, err := getGauge(fp, mt, 1, &messages.MetadataProperties{
+		OriginatingMetric: "targeted.metric",
+		CustomProperties:  map[string]string{"host": "a", "zone": ""},
+	})
+	assert.Nil(t, err)
+	gauge.Set(1)
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "other_flow_metric"})
+	sfxRegistry.MustRegister(other)
+	t.Cleanup(func() { sfxRegistry.Unregister(other) })
+
+	rec := httptest.NewRecorder()
+	targetsHandler(rec, httptest.NewRequest(http.MethodGet, "http://exporter:8080/-/targets", nil))
+	groups := []targetGroup{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&groups))
+	found := false
+	for _, g := range groups {
+		if g.Labels["flow"] == fp.Name {
+			found = true
+			assert.Equal(t, []string{"exporter:8080"}, g.Targets)
+			assert.Equal(t, fp.Name, g.Labels["__param_flow"])
+		}
+	}
+	assert.True(t, found)
+
+	rec = httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics?flow="+fp.Name, nil))
+	assert.Contains(t, rec.Body.String(), `targeted_metric{host="a",zone=""} 1`)
+	assert.NotContains(t, rec.Body.String(), "other_flow_metric")
+
+	rec = httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics?flow=unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCounterTotalSuffix(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+counterTotalSuffix: true
+flows:
+- name: suffixed
+  query: data('requests').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    name: '{{ .SignalFxMetricName }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	_, err := getCounter(fp, mt, 1, &messages.MetadataProperties{OriginatingMetric: "suffixed.requests"})
+	assert.Nil(t, err)
+	_, err = getCounter(fp, mt, 2, &messages.MetadataProperties{OriginatingMetric: "suffixed.requests_total"})
+	assert.Nil(t, err)
+
+	assert.Contains(t, sfxCounters, "suffixed_requests_total")
+	assert.NotContains(t, sfxCounters, "suffixed_requests")
+	assert.NotContains(t, sfxCounters, "suffixed_requests_total_total")
+}
+
+func TestAggregateWithout(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: aggregated
+  query: data('aggregated.requests').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    name: '{{ .SignalFxMetricName }}_total'
+    aggregateWithout: [host]
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+      service: '{{ .SignalFxLabels.service }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	for i, host := range []string{"a", "b", "c"} {
+		meta := &messages.MetadataProperties{
+			OriginatingMetric: "aggregated.requests",
+			CustomProperties:  map[string]string{"host": host, "service": "api"},
+		}
+		counter, err := getCounter(fp, mt, idtool.ID(i+1), meta)
+		assert.Nil(t, err)
+		counter.Add(2)
+		aggregate, err := getAggregateCounter(fp, mt, idtool.ID(i+1), meta)
+		assert.Nil(t, err)
+		aggregate.Add(2)
+	}
+
+	assert.Equal(t, 1, testutil.CollectAndCount(sfxCounters["aggregated_requests_aggregate_total"]))
+	assert.Equal(t, 6.0, testutil.ToFloat64(sfxCounters["aggregated_requests_aggregate_total"].WithLabelValues("api")))
+	assert.Equal(t, 3, testutil.CollectAndCount(sfxCounters["aggregated_requests_total"]))
+}
+
+func TestEmptyOriginatingMetric(t *testing.T) {
+	configFile := `---
+sfx:
+  token: xxx
+flows:
+- name: computed
+  query: data('computed.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`
+	props := &messages.MetadataProperties{
+		ResolutionMS:     10,
+		CustomProperties: map[string]string{"host": "a"},
+	}
+
+	// without a default name, such metrics are skipped
+	fp := loadFlow(t, configFile)
+	startFakeBackend(t, fp.Query, props, 5)
+	fp.Stop = time.Now().Add(300 * time.Millisecond)
+	assert.Nil(t, streamData(context.Background(), fp, newFlowState(fp.Name, "", 0, 0)))
+	assert.Greater(t, testutil.ToFloat64(flowMetricsSkipped.WithLabelValues(fp.Name, "default", skippedNoMetricName)), 0.0)
+	assert.NotContains(t, sfxGauges, "")
+
+	// with a default name, it is used instead
+	fp = loadFlow(t, strings.Replace(configFile, "name: computed", "name: computed\n  defaultMetricName: computed.fallback", 1))
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	_, err := getGauge(fp, mt, 1, props)
+	assert.Nil(t, err)
+	assert.Contains(t, sfxGauges, "computed_fallback")
+}
+
+func TestIngestionRateLimit(t *testing.T) {
+	ingestionLimiters["flooded"] = rate.NewLimiter(rate.Limit(1), 5)
+	t.Cleanup(func() { delete(ingestionLimiters, "flooded") })
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if allowIngestion("flooded") {
+			allowed++
+		}
+	}
+	assert.Equal(t, 5, allowed)
+	assert.Equal(t, 95.0, testutil.ToFloat64(flowRateLimited.WithLabelValues("flooded")))
+
+	// flows without limit are not affected
+	assert.True(t, allowIngestion("unlimited"))
+}
+
+func TestMetricHelp(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: helpful
+  query: data('helpful.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: helpful_ratio
+    help: 'Ratio of {{ .SignalFxMetricName }}'
+  - type: counter
+    stream: plain
+    name: plain_total
+`)
+	defer reapFlowSeries(fp.Name)
+	meta := &messages.MetadataProperties{OriginatingMetric: "helpful.metric"}
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	_, err := getGauge(fp, mt, 1, meta)
+	assert.Nil(t, err)
+	ct, _ := fp.GetMetricTemplateForStream("plain")
+	_, err = getCounter(fp, ct, 1, meta)
+	assert.Nil(t, err)
+
+	families, err := sfxRegistry.Gather()
+	assert.Nil(t, err)
+	help := map[string]string{}
+	for _, family := range families {
+		help[family.GetName()] = family.GetHelp()
+	}
+	assert.Equal(t, "Ratio of helpful_metric", help["helpful_ratio"])
+	assert.Equal(t, config.DefaultHelp, help["plain_total"])
+}
+
+func TestTSIDLabel(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: traced
+  query: data('traced.metric').publish()
+  tsidLabel: sfx_tsid
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	_, labelNames, labelValues, err := buildPrometheusMetadata(fp, mt, idtool.ID(1), &messages.MetadataProperties{
+		OriginatingMetric: "traced.metric",
+		CustomProperties:  map[string]string{"host": "a"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host", "sfx_tsid"}, labelNames)
+	assert.Equal(t, []string{"a", idtool.ID(1).String()}, labelValues)
+}
+
+func TestStaticLabels(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: static
+  query: data('static.metric').publish()
+  flowLabel: true
+  staticLabels:
+    env: prod
+    cluster: eu-1
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	_, labelNames, labelValues, err := buildPrometheusMetadata(fp, mt, idtool.ID(1), &messages.MetadataProperties{
+		OriginatingMetric: "static.metric",
+		CustomProperties:  map[string]string{"host": "a"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host", "cluster", "env", "flow"}, labelNames)
+	assert.Equal(t, []string{"a", "eu-1", "prod", "static"}, labelValues)
+}
+
+func TestLabelErrors(t *testing.T) {
+	meta := &messages.MetadataProperties{OriginatingMetric: "partial.metric", CustomProperties: map[string]string{"host": "a"}}
+	build := func(mode string) ([]string, error) {
+		fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: partial-`+mode+`
+  query: data('partial.metric').publish()
+  labelErrors: `+mode+`
+  labelFallback: unknown
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+      broken: '{{ .SignalFxLabels.host.nested }}'
+`)
+		mt, _ := fp.GetMetricTemplateForStream("default")
+		_, _, labelValues, err := buildPrometheusMetadata(fp, mt, idtool.ID(1), meta)
+		return labelValues, err
+	}
+
+	_, err := build("strict")
+	assert.NotNil(t, err)
+
+	labelValues, err := build("fallback")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unknown", "a"}, labelValues)
+	assert.Equal(t, 1.0, testutil.ToFloat64(labelFallbacks.WithLabelValues("partial-fallback", "broken")))
+
+	labelValues, err = build("drop")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "a"}, labelValues)
+}
+
+func TestObservabilityServerPortConflict(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	_, err = startObservabilityServer(port, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("port %v", port))
+}
+
+func TestShutdownServers(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	obsServer, err := startObservabilityServer(port, nil)
+	assert.Nil(t, err)
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%v/healthz", port))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	shutdownServers(context.Background(), map[string]*http.Server{"observability": obsServer, "scrape": nil})
+
+	// the port is released once the shutdown returned
+	listener, err = net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if assert.Nil(t, err) {
+		listener.Close()
+	}
+}
+
+func TestNameMapping(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: mapped
+  query: data('*.utilization').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: '{{ .SignalFxMetricName }}'
+`)
+	sfxNameMapping.replace(map[string]string{"cpu.utilization": "node_cpu_utilization_ratio"})
+	defer sfxNameMapping.replace(nil)
+
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	name, _, _, err := buildPrometheusMetadata(fp, mt, idtool.ID(1), &messages.MetadataProperties{OriginatingMetric: "cpu.utilization"})
+	assert.Nil(t, err)
+	assert.Equal(t, "node_cpu_utilization_ratio", name)
+
+	// unmapped metrics fall through to the template
+	name, _, _, err = buildPrometheusMetadata(fp, mt, idtool.ID(2), &messages.MetadataProperties{OriginatingMetric: "disk.utilization"})
+	assert.Nil(t, err)
+	assert.Equal(t, "disk_utilization", name)
+}
+
+func TestClassifyClose(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		reason string
+		code   string
+	}{
+		{nil, closeCompleted, closeCodeNone},
+		{errStreamClosed, closeTransient, closeCodeNone},
+		{&signalflow.ComputationError{Code: 401}, closeAuth, "401"},
+		{&signalflow.ComputationError{Code: 400, ErrorType: "ANALYTICS_PROGRAM_NAME_ERROR"}, closeProgram, "400"},
+		{&signalflow.ComputationError{Code: 503}, closeTransient, "503"},
+		{fmt.Errorf("wrapped - %w", &signalflow.ComputationError{Code: 403}), closeAuth, "403"},
+	} {
+		reason, code := classifyClose(tc.err)
+		assert.Equal(t, tc.reason, reason, "%v", tc.err)
+		assert.Equal(t, tc.code, code, "%v", tc.err)
+	}
+
+	assert.Equal(t, 2*time.Second, nextBackoff(time.Second, time.Minute))
+	assert.Equal(t, time.Minute, nextBackoff(40*time.Second, time.Minute))
+}
+
+func TestProbeLimit(t *testing.T) {
+	probeLimit = newProbeLimiter(1)
+	defer func() { probeLimit = nil }()
+	grouping := config.Grouping{Label: "host"}
+	rejected := testutil.ToFloat64(probesRejected)
+
+	// a probe in flight takes the only slot
+	assert.True(t, probeLimit.acquire())
+	rec := httptest.NewRecorder()
+	probeHandler(grouping, rec, httptest.NewRequest(http.MethodGet, "/metrics/host?target=a", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, rejected+1, testutil.ToFloat64(probesRejected))
+
+	probeLimit.release()
+	rec = httptest.NewRecorder()
+	probeHandler(grouping, rec, httptest.NewRequest(http.MethodGet, "/metrics/host?target=a", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 0, len(probeLimit.slots))
+}
+
+func TestMaxReconnects(t *testing.T) {
+	fp := config.FlowProgram{Name: "flaky", MaxReconnects: 1, ReconnectBackoff: time.Millisecond, MaxReconnectBackoff: time.Millisecond}
+	state := newFlowState(fp.Name, "", 0, 0)
+	attempts := 0
+	err := runFlow(context.Background(), fp, state, func() error {
+		attempts++
+		return errStreamClosed
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, flowDead, state.status().State)
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowGaveUp.WithLabelValues(fp.Name)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowReconnects.WithLabelValues(fp.Name)))
+
+	// auth errors are final right away
+	state = newFlowState("unauthorized", "", 0, 0)
+	err = runFlow(context.Background(), config.FlowProgram{Name: "unauthorized"}, state, func() error {
+		return &signalflow.ComputationError{Code: 401}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, flowFailed, state.status().State)
+}
+
+func TestFlowInfo(t *testing.T) {
+	cfg, err := config.LoadConfigFromBytes([]byte(`---
+sfx:
+  token: xxx
+  realm: eu0
+flows:
+- name: described
+  query: data('a').publish(label='a'); data('b').publish(label='b')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+  - type: counter
+    stream: b
+`))
+	assert.Nil(t, err)
+	setFlowInfo(cfg)
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowInfo.WithLabelValues("described", "eu0", "counter,gauge", "2")))
+	assert.Equal(t, 1, testutil.CollectAndCount(flowInfo))
+}
+
+func TestNoFlowsUnready(t *testing.T) {
+	noFlowsUnready = true
+	defer func() { noFlowsUnready = false }()
+	rec := httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestReadiness(t *testing.T) {
+	flowStatesLock.Lock()
+	saved := flowStates
+	flowStates = make(map[string]*flowState)
+	flowStatesLock.Unlock()
+	defer func() {
+		flowStatesLock.Lock()
+		flowStates = saved
+		flowStatesLock.Unlock()
+	}()
+
+	streaming := newFlowState("streaming", "", 0, 0)
+	connecting := newFlowState("connecting", "", 0, 0)
+	finished := newFlowState("finished", "", 0, 0)
+	streaming.setState(flowStreaming)
+	finished.payloadReceived()
+	finished.setState(flowFinished)
+
+	rec := httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var readiness Readiness
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&readiness))
+	assert.Equal(t, []string{"connecting", "streaming"}, readiness.Unready)
+
+	streaming.payloadReceived()
+	connecting.setState(flowStreaming)
+	connecting.payloadReceived()
+	rec = httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// a dropped stream is not ready until it is streaming again
+	connecting.reconnecting(errors.New("stream closed"))
+	rec = httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// unless the grace period is over
+	defer func() { readyAfter = time.Time{} }()
+	readyAfter = time.Now().Add(time.Minute)
+	rec = httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	readyAfter = time.Now().Add(-time.Second)
+	rec = httptest.NewRecorder()
+	readinessHandler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReloadAddsRealmLimiters(t *testing.T) {
+	defer func() {
+		realmLimitersLock.Lock()
+		delete(realmLimiters, "reloaded0")
+		delete(realmLimiters, "reloaded1")
+		realmLimitersLock.Unlock()
+	}()
+	setRealmLimiters(map[string]int{"reloaded0": 2})
+	setRealmLimiters(map[string]int{"reloaded0": 5, "reloaded1": 3})
+
+	// running flows hold the slots of the existing limiter
+	assert.Equal(t, 2, cap(getRealmLimiter("reloaded0").slots))
+	assert.Equal(t, 3, cap(getRealmLimiter("reloaded1").slots))
+}
+
+func TestRealmConcurrencyLimit(t *testing.T) {
+	cfg, err := config.LoadConfigFromBytes([]byte(`---
+sfx:
+  token: xxx
+  realm: limited0
+  maxConcurrentPrograms: 1
+flows:
+- name: queued
+  query: data('a').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`))
+	assert.Nil(t, err)
+	fp := cfg.Flows[0]
+	limiter := newRealmLimiter(fp.Realm(), cfg.Sfx.MaxConcurrentPrograms)
+	realmLimiters[fp.Realm()] = limiter
+	defer delete(realmLimiters, fp.Realm())
+
+	// another flow runs a program already
+	assert.True(t, limiter.tryAcquire())
+	state := newFlowState(fp.Name, "", 0, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runFlow(context.Background(), fp, state, func() error { return nil })
+	}()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(realmFlowsQueued.WithLabelValues(fp.Realm())) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, flowQueued, state.status().State)
+
+	limiter.release()
+	<-done
+	assert.Equal(t, 0.0, testutil.ToFloat64(realmFlowsQueued.WithLabelValues(fp.Realm())))
+	assert.Equal(t, 0, len(limiter.slots))
+}
+
+func TestDumpHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "dumped", Help: "dumped"}, []string{"host"})
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("a").Set(1.5)
+	sfxSeries.touch("dump", "dumped", []string{"host"}, []string{"a"}, 0)
+	gatherer := sfxBaseGatherer
+	sfxBaseGatherer = registry
+	dumpToken = "secret"
+	defer func() {
+		sfxBaseGatherer = gatherer
+		dumpToken = ""
+		sfxSeries.removeFlow("dump")
+	}()
+
+	request := func(query string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/-/dump"+query, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		dumpHandler(rec, r)
+		return rec
+	}
+	assert.Equal(t, http.StatusUnauthorized, request("", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("", "wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, request("?format=xml", "secret").Code)
+
+	rec := request("?format=json", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var dumps []SeriesDump
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &dumps))
+	assert.Equal(t, 1, len(dumps))
+	assert.Equal(t, "gauge", dumps[0].Type)
+	assert.Equal(t, map[string]string{"host": "a"}, dumps[0].Labels)
+	assert.Equal(t, 1.5, *dumps[0].Value)
+	assert.NotNil(t, dumps[0].LastUpdate)
+
+	rec = request("?format=csv", "secret")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	assert.Equal(t, "name,type,labels,value,last_update", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], `dumped,gauge,"host=""a""",1.5,`))
+}
+
+func TestTypedProperties(t *testing.T) {
+	var meta messages.MetadataProperties
+	err := json.Unmarshal([]byte(`{
+		"sf_originatingMetric": "typed.metric",
+		"sf_resolutionMs": 10000,
+		"sf_isPreQuantized": true,
+		"account_id": 1234567,
+		"ratio": 0.25,
+		"tiny": 0.00001,
+		"enabled": false,
+		"owner": null,
+		"host": "a"
+	}`), &meta)
+	assert.Nil(t, err)
+
+	vars := buildTemplateVars(config.FlowProgram{}, &meta)
+	assert.Equal(t, map[string]string{
+		"account_id": "1234567",
+		"ratio":      "0.25",
+		"tiny":       "0.00001",
+		"enabled":    "false",
+		"owner":      "",
+		"host":       "a",
+	}, vars.SignalFxLabels)
+	assert.Equal(t, "10000", vars.SignalFxInternal["sf_resolutionMs"])
+	assert.Equal(t, "true", vars.SignalFxInternal["sf_isPreQuantized"])
+
+	// string properties are left alone
+	properties := map[string]string{"host": "a"}
+	assert.Equal(t, properties, coerceCustomProperties(properties))
+	assert.Equal(t, "[\"a\",1]", propertyString([]interface{}{"a", 1.0}))
+}
+
+func TestConcurrentMetricRegistration(t *testing.T) {
+	cfg, err := config.LoadConfigFromBytes([]byte(`---
+sfx:
+  token: xxx
+flows:
+- name: racing-a
+  query: data('raced').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: raced_gauge
+  - type: counter
+    name: raced_total
+    stream: counter
+- name: racing-b
+  query: data('raced').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: raced_gauge
+  - type: counter
+    name: raced_total
+    stream: counter
+`))
+	assert.Nil(t, err)
+
+	defer reapFlowSeries("racing-a")
+	defer reapFlowSeries("racing-b")
+
+	// each flow runs in its own goroutine, registering the same metric names
+	done := make(chan struct{})
+	for i, fp := range cfg.Flows {
+		go func(i int, fp config.FlowProgram) {
+			defer func() { done <- struct{}{} }()
+			gt, _ := fp.GetMetricTemplateForStream("default")
+			ct, _ := fp.GetMetricTemplateForStream("counter")
+			for j := 0; j < 200; j++ {
+				tsid := idtool.ID(i*1000 + j + 1)
+				meta := &messages.MetadataProperties{OriginatingMetric: "raced"}
+				gauge, err := getGauge(fp, gt, tsid, meta)
+				assert.Nil(t, err)
+				gauge.Set(1)
+				counter, err := getCounter(fp, ct, tsid, meta)
+				assert.Nil(t, err)
+				counter.Inc()
+			}
+		}(i, fp)
+	}
+	for range cfg.Flows {
+		<-done
+	}
+	assert.Equal(t, 1, testutil.CollectAndCount(sfxGauges["raced_gauge"]))
+	assert.Equal(t, 400.0, testutil.ToFloat64(sfxCounters["raced_total"]))
+}
+
+func TestHistogram(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: distributed
+  query: data('request.latency').publish()
+  prometheusMetricTemplates:
+  - type: histogram
+    name: request_latency_seconds
+    buckets: [0.1, 1]
+`)
+	defer reapFlowSeries(fp.Name)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	for i, value := range []float64{0.05, 0.5, 5} {
+		histogram, err := getHistogram(fp, mt, idtool.ID(1), &messages.MetadataProperties{OriginatingMetric: "request.latency"})
+		assert.Nil(t, err, "payload %d", i)
+		histogram.Observe(value)
+	}
+
+	var m dto.Metric
+	assert.Nil(t, sfxHistograms["request_latency_seconds"].WithLabelValues().(prometheus.Metric).Write(&m))
+	assert.Equal(t, uint64(3), m.GetHistogram().GetSampleCount())
+	assert.Equal(t, 5.55, m.GetHistogram().GetSampleSum())
+	buckets := m.GetHistogram().GetBucket()
+	assert.Equal(t, 2, len(buckets))
+	assert.Equal(t, uint64(1), buckets[0].GetCumulativeCount())
+	assert.Equal(t, uint64(2), buckets[1].GetCumulativeCount())
+}
+
+func TestSummary(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: summarized
+  query: data('request.duration').publish()
+  prometheusMetricTemplates:
+  - type: summary
+    name: request_duration_seconds
+    objectives: {0.5: 0.05}
+`)
+	defer reapFlowSeries(fp.Name)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	for _, value := range []float64{1, 2, 3} {
+		summary, err := getSummary(fp, mt, idtool.ID(1), &messages.MetadataProperties{OriginatingMetric: "request.duration"})
+		assert.Nil(t, err)
+		summary.Observe(value)
+	}
+
+	var m dto.Metric
+	assert.Nil(t, sfxSummaries["request_duration_seconds"].WithLabelValues().(prometheus.Metric).Write(&m))
+	assert.Equal(t, uint64(3), m.GetSummary().GetSampleCount())
+	assert.Equal(t, 6.0, m.GetSummary().GetSampleSum())
+	assert.Equal(t, 1, len(m.GetSummary().GetQuantile()))
+	assert.Equal(t, 2.0, m.GetSummary().GetQuantile()[0].GetValue())
+}
+
+func TestReservedMetadataLabels(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+reservedLabels: prefix
+flows:
+- name: reserved
+  query: data('reserved.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    exportMetadata: true
+    labels:
+      job: '{{ .SignalFxLabels.job }}'
+`)
+	defer reapFlowSeries(fp.Name)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	meta := &messages.MetadataProperties{
+		OriginatingMetric: "reserved.metric",
+		CustomProperties:  map[string]string{"job": "batch", "instance": "i-1"},
+	}
+	_, err := getGauge(fp, mt, 1, meta)
+	assert.Nil(t, err)
+
+	expected := `
+# HELP reserved_metric_meta SignalFX metadata of reserved_metric
+# TYPE reserved_metric_meta gauge
+reserved_metric_meta{sfx_instance="i-1",sfx_job="batch"} 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(sfxRegistry, strings.NewReader(expected), "reserved_metric_meta"))
+}
+
+func TestFailingNameTemplateIsCounted(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: misnamed
+  query: data('misnamed.metric').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: '{{ .Nonexistent }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	gauge, err := getGauge(fp, mt, 1, &messages.MetadataProperties{OriginatingMetric: "misnamed.metric"})
+	assert.NotNil(t, err)
+	assert.Nil(t, gauge)
+	counter, err := getCounter(fp, mt, 1, &messages.MetadataProperties{OriginatingMetric: "misnamed.metric"})
+	assert.NotNil(t, err)
+	assert.Nil(t, counter)
+
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric: "misnamed.metric",
+		ResolutionMS:      10,
+	}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+	state := newFlowState(fp.Name, "", 0, 0)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+	received := testutil.ToFloat64(flowMetricsReceived.WithLabelValues(fp.Name, "default"))
+	assert.Greater(t, received, 0.0)
+	assert.Equal(t, received, testutil.ToFloat64(flowMetricsFailed.WithLabelValues(fp.Name, "default")))
+}
+
+func TestStaleSeries(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: vanishing
+  query: data('host.up').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: host_up
+    staleAfter: 1m
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	defer reapFlowSeries(fp.Name)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	for i, host := range []string{"a", "b"} {
+		gauge, err := getGauge(fp, mt, idtool.ID(i), &messages.MetadataProperties{
+			OriginatingMetric: "host.up",
+			CustomProperties:  map[string]string{"host": host},
+		})
+		assert.Nil(t, err)
+		gauge.Set(1)
+	}
+	gatherer := &StaleSeriesGatherer{Gatherer: sfxRegistry, Stale: sfxSeries.exposedStaleKeys}
+	hosts := func() []string {
+		mfs, err := gatherer.Gather()
+		assert.Nil(t, err)
+		hosts := []string{}
+		for _, mf := range mfs {
+			if mf.GetName() == "host_up" {
+				for _, m := range mf.GetMetric() {
+					hosts = append(hosts, m.GetLabel()[0].GetValue())
+				}
+			}
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"a", "b"}, hosts())
+
+	// host b stops reporting
+	sfxSeries.mu.Lock()
+	sfxSeries.series[seriesKey("host_up", []string{"b"})].lastUpdate = time.Now().Add(-2 * time.Minute)
+	sfxSeries.mu.Unlock()
+	assert.Equal(t, []string{"a"}, hosts())
+	assert.Equal(t, 2, testutil.CollectAndCount(sfxGauges["host_up"]), "hidden series are kept until reaped")
+
+	assert.Equal(t, 0, reapStaleSeries(time.Now().Add(-90*time.Second)))
+	assert.Equal(t, 1, reapStaleSeries(time.Now()))
+	assert.Equal(t, 1, testutil.CollectAndCount(sfxGauges["host_up"]))
+	assert.Equal(t, 1, sfxSeries.countForFlow(fp.Name))
+	assert.Equal(t, []string{"a"}, hosts())
+	sfxLabels.mu.Lock()
+	_, cached := sfxLabels.entries[labelCacheKey{flow: fp.Name, tsid: idtool.ID(1), stream: "default"}]
+	assert.False(t, cached, "the rendering of the reaped series is forgotten")
+	assert.Contains(t, sfxLabels.entries, labelCacheKey{flow: fp.Name, tsid: idtool.ID(0), stream: "default"})
+	sfxLabels.mu.Unlock()
+}
+
+func TestCountSamples(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: sampled
+  query: data('sampled.requests').publish()
+  countSamples: true
+  counterTotalSuffix: true
+  prometheusMetricTemplates:
+  - type: counter
+    name: sampled_requests
+`)
+	defer reapFlowSeries(fp.Name)
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric: "sampled.requests",
+		ResolutionMS:      10,
+	}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+	state := newFlowState(fp.Name, "", 0, 0)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+	received := testutil.ToFloat64(flowMetricsReceived.WithLabelValues(fp.Name, "default"))
+	assert.Greater(t, received, 0.0)
+	assert.Equal(t, received, testutil.ToFloat64(metricSamples.WithLabelValues(fp.Name, "sampled_requests_total")))
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	assert.Equal(t, scrapeTimeout, scrapeTimeoutFor(r))
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "9.5")
+	assert.Equal(t, 9500*time.Millisecond, scrapeTimeoutFor(r))
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "soon")
+	assert.Equal(t, scrapeTimeout, scrapeTimeoutFor(r))
+
+	// the timeout parameter is capped by the timeout of the scraper
+	r = httptest.NewRequest(http.MethodGet, "/metrics?timeout=20s", nil)
+	assert.Equal(t, 20*time.Second, scrapeTimeoutFor(r))
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "9.5")
+	assert.Equal(t, 9500*time.Millisecond, scrapeTimeoutFor(r))
+	r = httptest.NewRequest(http.MethodGet, "/metrics?timeout=2s", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "9.5")
+	assert.Equal(t, 2*time.Second, scrapeTimeoutFor(r))
+
+	// the request has less time left than the scrape
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	assert.LessOrEqual(t, int64(scrapeTimeoutFor(r.WithContext(ctx))), int64(time.Second))
+}
+
+func TestFlowFailure(t *testing.T) {
+	fp := config.FlowProgram{Name: "rejected"}
+	rejected := &signalflow.ComputationError{Code: 401}
+	assert.Nil(t, flowFailure(fp, nil))
+	assert.Equal(t, 0.0, testutil.ToFloat64(flowErrors.WithLabelValues(fp.Name)))
+
+	// the other flows keep running
+	assert.Nil(t, flowFailure(fp, rejected))
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowErrors.WithLabelValues(fp.Name)))
+
+	failFast = true
+	defer func() { failFast = false }()
+	assert.Equal(t, rejected, flowFailure(fp, rejected))
+	assert.Equal(t, 2.0, testutil.ToFloat64(flowErrors.WithLabelValues(fp.Name)))
+}
+
+func TestSelfMetrics(t *testing.T) {
+	flowCircuitOpen.WithLabelValues("self").Set(0)
+	grouping := config.Grouping{Label: "host"}
+	probe := func() string {
+		rec := httptest.NewRecorder()
+		probeHandler(grouping, rec, httptest.NewRequest(http.MethodGet, "/metrics/host?target=a", nil))
+		return rec.Body.String()
+	}
+	assert.NotContains(t, probe(), "sfxpe_flow_circuit_open")
+
+	setupSelfMetrics()
+	defer func() { selfGatherer = nil }()
+	body := probe()
+	assert.Contains(t, body, `sfxpe_flow_circuit_open{flow="self"} 0`)
+	assert.NotContains(t, body, "sfxpe_flow_metrics_received_total")
+}
+
+func TestMetadataDebounce(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: flapping
+  query: data('flapping').publish()
+  metadataDebounce: 50ms
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	defer reapFlowSeries(fp.Name)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	meta := func(host string) *messages.MetadataProperties {
+		return &messages.MetadataProperties{OriginatingMetric: "flapping", CustomProperties: map[string]string{"host": host}}
+	}
+	host := func(sfxMeta *messages.MetadataProperties) string {
+		_, _, labelValues, err := sfxLabels.render(fp, mt, idtool.ID(1), sfxMeta)
+		assert.Nil(t, err)
+		return labelValues[0]
+	}
+	debounced := testutil.ToFloat64(metadataDebounced.WithLabelValues(fp.Name))
+
+	assert.Equal(t, "a", host(meta("a")))
+	assert.Equal(t, "a", host(meta("b")))
+	flapped := meta("c")
+	assert.Equal(t, "a", host(flapped))
+	assert.Equal(t, debounced+2, testutil.ToFloat64(metadataDebounced.WithLabelValues(fp.Name)))
+
+	// the metadata stopped changing
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, "c", host(flapped))
+}
+
+func TestReconnectBackoffReset(t *testing.T) {
+	fp := config.FlowProgram{
+		Name:                 "established",
+		ReconnectBackoff:     50 * time.Millisecond,
+		MaxReconnectBackoff:  time.Second,
+		StableStreamDuration: 20 * time.Millisecond,
+	}
+	state := newFlowState(fp.Name, "", 0, 0)
+	var lastEnd time.Time
+	var waits []time.Duration
+	attempts := 0
+	runFlow(context.Background(), fp, state, func() error {
+		attempts++
+		if !lastEnd.IsZero() {
+			waits = append(waits, time.Since(lastEnd))
+		}
+		defer func() { lastEnd = time.Now() }()
+		switch attempts {
+		case 4:
+			// the stream got going before it dropped
+			time.Sleep(25 * time.Millisecond)
+		case 5:
+			return &signalflow.ComputationError{Code: 401}
+		}
+		return errStreamClosed
+	})
+	assert.Equal(t, 4, len(waits))
+	assert.GreaterOrEqual(t, int64(waits[2]), int64(200*time.Millisecond))
+	assert.Less(t, int64(waits[3]), int64(200*time.Millisecond))
+}
+
+func TestPayloadWithoutMetadata(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: metadataless
+  query: data('metadataless').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`)
+	defer reapFlowSeries(fp.Name)
+	backend := startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric: "metadataless",
+		ResolutionMS:      10,
+	}, 5)
+	// a second time series sends payloads without any metadata
+	backend.AddProgramTSIDs(fp.Query, []idtool.ID{1, 2})
+	backend.SetTSIDFloatData(idtool.ID(2), 7)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+	state := newFlowState(fp.Name, "", 0, 0)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+	assert.Greater(t, testutil.ToFloat64(flowMetricsFailed.WithLabelValues(fp.Name, streamUnknown)), 0.0)
+	assert.Equal(t, 0.0, testutil.ToFloat64(flowMetricsFailed.WithLabelValues(fp.Name, "default")))
+	assert.Greater(t, testutil.ToFloat64(flowMetricsReceived.WithLabelValues(fp.Name, "default")), 0.0)
+
+	_, _, _, err := buildPrometheusMetadata(fp, fp.MetricTemplates[0], idtool.ID(2), nil)
+	assert.Equal(t, errNoMetadata, err)
+}
+
+func TestProbeResponseStats(t *testing.T) {
+	probed := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "probed", Help: "probed"}, []string{"host"})
+	probed.WithLabelValues("a").Set(1)
+	sfxRegistry.MustRegister(probed)
+	defer sfxRegistry.Unregister(probed)
+
+	responses := func() (uint64, float64) {
+		var m dto.Metric
+		assert.Nil(t, probeResponseBytes.WithLabelValues("host").(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	count, sum := responses()
+
+	grouping := config.Grouping{Label: "host"}
+	rec := httptest.NewRecorder()
+	probeHandler(grouping, rec, httptest.NewRequest(http.MethodGet, "/metrics/host?target=a", nil))
+	assert.Contains(t, rec.Body.String(), `probed{host="a"} 1`)
+
+	newCount, newSum := responses()
+	assert.Equal(t, count+1, newCount)
+	assert.Equal(t, float64(rec.Body.Len()), newSum-sum)
+	assert.Greater(t, testutil.ToFloat64(probeGatherAlloc.WithLabelValues("host")), 0.0)
+
+	gathers := func(matched string) uint64 {
+		var m dto.Metric
+		assert.Nil(t, registryGatherTime.WithLabelValues("host", matched).(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	unmatched, matched := gathers("false"), gathers("true")
+	rec = httptest.NewRecorder()
+	probeHandler(grouping, rec, httptest.NewRequest(http.MethodGet, "/metrics/host?target=a&match[]=probed", nil))
+	assert.Contains(t, rec.Body.String(), `probed{host="a"} 1`)
+	assert.Equal(t, unmatched, gathers("false"))
+	assert.Equal(t, matched+1, gathers("true"))
+}
+
+func TestUnmappedStreamIsSkipped(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: unmapped
+  query: data('unmapped').publish('b')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+`)
+	defer reapFlowSeries(fp.Name)
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric:  "unmapped",
+		ResolutionMS:       10,
+		InternalProperties: map[string]interface{}{"sf_streamLabel": "b"},
+	}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+	state := newFlowState(fp.Name, "", 0, 1)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+	assert.Greater(t, testutil.ToFloat64(flowMetricsSkipped.WithLabelValues(fp.Name, "b", skippedUnmapped)), 0.0)
+	assert.Equal(t, 0.0, testutil.ToFloat64(flowMetricsFailed.WithLabelValues(fp.Name, "b")))
+}
+
+func TestInvalidRenderedNameIsCounted(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: nameless
+  query: data('nameless').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: '{{ .SignalFxLabels.missing }}'
+`)
+	defer reapFlowSeries(fp.Name)
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{OriginatingMetric: "nameless", ResolutionMS: 10}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+	state := newFlowState(fp.Name, "", 0, 0)
+	assert.Nil(t, streamData(context.Background(), fp, state))
+	assert.Greater(t, testutil.ToFloat64(flowMetricsFailed.WithLabelValues(fp.Name, "default")), 0.0)
+
+	mt, _ := fp.GetMetricTemplateForStream("default")
+	_, _, _, err := buildPrometheusMetadata(fp, mt, idtool.ID(1), &messages.MetadataProperties{OriginatingMetric: "nameless"})
+	assert.Contains(t, err.Error(), "not a valid Prometheus metric name")
+}
+
+func TestConflictingMetricsAreRejected(t *testing.T) {
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: conflicting
+  query: data('a').publish('a'); data('b').publish('b'); data('c').publish('c')
+  prometheusMetricTemplates:
+  - type: gauge
+    stream: a
+    name: conflicting_metric
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+  - type: gauge
+    stream: b
+    name: conflicting_metric
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+      region: '{{ .SignalFxLabels.region }}'
+  - type: histogram
+    stream: c
+    name: conflicting_metric
+    buckets: [1]
+    labels:
+      host: '{{ .SignalFxLabels.host }}'
+`)
+	defer reapFlowSeries(fp.Name)
+	meta := &messages.MetadataProperties{OriginatingMetric: "a", CustomProperties: map[string]string{"host": "a", "region": "eu"}}
+	a, _ := fp.GetMetricTemplateForStream("a")
+	_, err := getGauge(fp, a, 1, meta)
+	assert.Nil(t, err)
+
+	// another label set or type for the same name fails instead of panicking
+	b, _ := fp.GetMetricTemplateForStream("b")
+	_, err = getGauge(fp, b, 2, meta)
+	assert.Contains(t, err.Error(), "registered with [host]")
+	c, _ := fp.GetMetricTemplateForStream("c")
+	_, err = getHistogram(fp, c, 3, meta)
+	assert.NotNil(t, err)
+}
+
+func TestDebugSampleRate(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	samples := []float64{0.1, 0.9}
+	defer func(r func() float64) { sampleRand = r }(sampleRand)
+	sampleRand = func() float64 {
+		sample := samples[0]
+		samples = append(samples[1:], sample)
+		return sample
+	}
+
+	fp := loadFlow(t, `---
+sfx:
+  token: xxx
+flows:
+- name: sampled
+  query: data('sampled').publish()
+  debugSampleRate: 0.5
+  prometheusMetricTemplates:
+  - type: gauge
+`)
+	defer reapFlowSeries(fp.Name)
+	startFakeBackend(t, fp.Query, &messages.MetadataProperties{
+		OriginatingMetric: "sampled",
+		ResolutionMS:      10,
+	}, 5)
+	fp.Stop = time.Now().Add(500 * time.Millisecond)
+	received := testutil.ToFloat64(flowMetricsReceived.WithLabelValues(fp.Name, "default"))
+	assert.Nil(t, streamData(context.Background(), fp, newFlowState(fp.Name, "", 0, 0)))
+	received = testutil.ToFloat64(flowMetricsReceived.WithLabelValues(fp.Name, "default")) - received
+
+	sampled := logs.FilterMessageSnippet("flow sampled sampled payload")
+	assert.Greater(t, sampled.Len(), 0)
+	// every other payload passes the gate
+	assert.InDelta(t, received/2, float64(sampled.Len()), 1)
+	assert.Contains(t, sampled.All()[0].Message, "metric=sampled")
+}
+
+func TestBuildInfo(t *testing.T) {
+	assert.Equal(t, 1.0, testutil.ToFloat64(buildInfo.WithLabelValues("unknown", "unknown", runtime.Version())))
+	assert.Equal(t, 1, testutil.CollectAndCount(buildInfo))
+}
+
+// writeSelfSignedCert writes a certificate for localhost and its key to dir
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	tlsConfig, err := serverTLSConfig(nil, true)
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	settings := &config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}
+	tlsConfig, err = serverTLSConfig(settings, false)
+	assert.Nil(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+
+	tlsConfig, err = serverTLSConfig(settings, true)
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+	assert.NotNil(t, tlsConfig.ClientCAs)
+
+	_, err = serverTLSConfig(&config.TLS{CertFile: certFile, KeyFile: certFile}, false)
+	assert.NotNil(t, err)
+	_, err = serverTLSConfig(&config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, true)
+	assert.NotNil(t, err)
+
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	tlsConfig, err = serverTLSConfig(settings, false)
+	assert.Nil(t, err)
+	obsServer, err := startObservabilityServer(port, tlsConfig)
+	assert.Nil(t, err)
+	defer obsServer.Close()
+
+	pool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(certFile)
+	assert.Nil(t, err)
+	pool.AppendCertsFromPEM(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(fmt.Sprintf("https://localhost:%v/metrics", port))
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestReloadFlows(t *testing.T) {
+	load := func(flows string) *config.Config {
+		cfg, err := config.LoadConfigFromBytes([]byte(`---
+sfx:
+  token: xxx
+flowLabel: true
+flows:
+` + flows))
+		assert.Nil(t, err)
+		return cfg
+	}
+	flow := func(name string, query string) string {
+		return fmt.Sprintf("- name: %s\n  query: %s\n  prometheusMetricTemplates:\n  - type: gauge\n", name, query)
+	}
+	/* the fake backend doesn't handle concurrent connections, so every flow
+	and query gets its own. it also deadlocks once a client disconnects in the
+	middle of the stream, so the backends are not stopped */
+	backends := make(map[string]*signalflow.FakeBackend)
+	defer func(params func(config.FlowProgram) []signalflow.ClientParam) {
+		signalflowClientParams = params
+	}(signalflowClientParams)
+	signalflowClientParams = func(fp config.FlowProgram) []signalflow.ClientParam {
+		backend := backends[fp.Name+fp.Query]
+		return []signalflow.ClientParam{
+			signalflow.StreamURL(backend.URL()),
+			signalflow.AccessToken(backend.AccessToken),
+		}
+	}
+	for _, name := range []string{"kept", "changed", "removed", "added"} {
+		for _, query := range []string{"data('a').publish()", "data('b').publish()"} {
+			backend := signalflow.NewRunningFakeBackend()
+			backend.AddProgramTSIDs(query, []idtool.ID{1})
+			backend.AddTSIDMetadata(idtool.ID(1), &messages.MetadataProperties{OriginatingMetric: "reloaded", ResolutionMS: 10})
+			backend.SetTSIDFloatData(idtool.ID(1), 1)
+			backends[name+query] = backend
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs, ctx := errgroup.WithContext(ctx)
+	sv := newFlowSupervisor(ctx, errs, &config.Config{})
+	defer func() {
+		cancel()
+		errs.Wait()
+		for _, name := range []string{"kept", "changed", "removed", "added"} {
+			removeFlowState(name)
+		}
+	}()
+	for _, fp := range load(flow("kept", "data('a').publish()") + flow("changed", "data('a').publish()") + flow("removed", "data('a').publish()")).Flows {
+		sv.start(fp)
+	}
+	kept := sv.flows["kept"]
+	assert.Eventually(t, func() bool {
+		state, _ := getFlowState("kept")
+		return state.ready()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	started, stopped, restarted := sv.reload(load(flow("kept", "data('a').publish()") + flow("changed", "data('b').publish()") + flow("added", "data('b').publish()")))
+	assert.Equal(t, []string{"added"}, started)
+	assert.Equal(t, []string{"removed"}, stopped)
+	assert.Equal(t, []string{"changed"}, restarted)
+
+	// unchanged flows keep streaming
+	assert.Same(t, kept, sv.flows["kept"])
+	select {
+	case <-kept.done:
+		t.Error("unchanged flow was stopped")
+	default:
+	}
+	_, ok := getFlowState("removed")
+	assert.False(t, ok)
+	assert.Equal(t, 0, sfxSeries.countForFlow("removed"))
+	assert.Eventually(t, func() bool {
+		state, _ := getFlowState("added")
+		return state.ready()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloadChangedLabels(t *testing.T) {
+	load := func(labels string) *config.Config {
+		cfg, err := config.LoadConfigFromBytes([]byte(`---
+sfx:
+  token: xxx
+flows:
+- name: relabeled
+  query: data('relabeled').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    labels:
+` + labels))
+		assert.Nil(t, err)
+		return cfg
+	}
+	// one backend per config, as the fake backend deadlocks once a client
+	// disconnects in the middle of the stream
+	backends := make(map[int]*signalflow.FakeBackend)
+	defer func(params func(config.FlowProgram) []signalflow.ClientParam) {
+		signalflowClientParams = params
+	}(signalflowClientParams)
+	signalflowClientParams = func(fp config.FlowProgram) []signalflow.ClientParam {
+		backend := backends[len(fp.MetricTemplates[0].Labels)]
+		return []signalflow.ClientParam{
+			signalflow.StreamURL(backend.URL()),
+			signalflow.AccessToken(backend.AccessToken),
+		}
+	}
+	for _, labels := range []int{1, 2} {
+		backend := signalflow.NewRunningFakeBackend()
+		backend.AddProgramTSIDs("data('relabeled').publish()", []idtool.ID{1})
+		backend.AddTSIDMetadata(idtool.ID(1), &messages.MetadataProperties{
+			OriginatingMetric: "relabeled",
+			ResolutionMS:      10,
+			CustomProperties:  map[string]string{"host": "a", "region": "eu"},
+		})
+		backend.SetTSIDFloatData(idtool.ID(1), 1)
+		backends[labels] = backend
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs, ctx := errgroup.WithContext(ctx)
+	sv := newFlowSupervisor(ctx, errs, &config.Config{})
+	defer func() {
+		cancel()
+		errs.Wait()
+		removeFlowState("relabeled")
+	}()
+	exported := func() bool {
+		sfxMetricsLock.RLock()
+		gauge, ok := sfxGauges["relabeled"]
+		sfxMetricsLock.RUnlock()
+		return ok && testutil.CollectAndCount(gauge) == 1
+	}
+	sv.start(load("      host: '{{ .SignalFxLabels.host }}'\n").Flows[0])
+	assert.Eventually(t, exported, 5*time.Second, 10*time.Millisecond)
+
+	_, _, restarted := sv.reload(load("      host: '{{ .SignalFxLabels.host }}'\n      region: '{{ .SignalFxLabels.region }}'\n"))
+	assert.Equal(t, []string{"relabeled"}, restarted)
+	assert.Eventually(t, exported, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"host", "region"}, sfxLabelNames["relabeled"])
+	assert.Equal(t, 0.0, testutil.ToFloat64(flowMetricsFailed.WithLabelValues("relabeled", "default")))
+}
+
+func TestHaltedFlows(t *testing.T) {
+	for _, tc := range []struct {
+		state  string
+		exited bool
+		halted bool
+	}{
+		{flowStreaming, false, false},
+		{flowDisabled, false, true},
+		{flowFailed, true, true},
+		{flowDead, true, true},
+		{flowFinished, true, false},
+	} {
+		running := &runningFlow{done: make(chan struct{}), state: newFlowState("halted", "", 0, 0)}
+		running.state.setState(tc.state)
+		if tc.exited {
+			close(running.done)
+		}
+		assert.Equal(t, tc.halted, running.halted(), tc.state)
+	}
+	removeFlowState("halted")
+}
+
+func TestMetadataDimensionCollisions(t *testing.T) {
+	mc := newMetadataCollector()
+	// both sanitize to a_b, the first dimension by name wins on every run
+	assert.Nil(t, mc.set("collided", nil, nil, map[string]string{"a.b": "dot", "a-b": "dash"}))
+
+	var m dto.Metric
+	for _, metric := range mc.series {
+		assert.Nil(t, metric.Write(&m))
+	}
+	assert.Len(t, m.GetLabel(), 1)
+	assert.Equal(t, "a_b", m.GetLabel()[0].GetName())
+	assert.Equal(t, "dash", m.GetLabel()[0].GetValue())
+}
@@ -0,0 +1,39 @@
+package serve
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"signalfx-prometheus-exporter/config"
+)
+
+// serverTLSConfig loads the certificate of a server, nil without TLS.
+//
+// with verifyClients, servers require client certificates signed by the
+// configured client CA, if there is one.
+func serverTLSConfig(settings *config.TLS, verifyClients bool) (*tls.Config, error) {
+	if !settings.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate %s - %s", settings.CertFile, err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if !verifyClients || settings.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(settings.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read TLS client CA %s - %s", settings.ClientCAFile, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("TLS client CA %s contains no PEM encoded certificate", settings.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
@@ -0,0 +1,38 @@
+package serve
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	sfxRegistry.MustRegister(vectorCollector{})
+}
+
+// vectorCollector exposes the vectors flows build for their metrics. a registry
+// pins the label names of a metric name for good once a collector describing
+// it was registered, so the collector is unchecked and describes nothing, which
+// lets a restarted flow build its vectors again with other label names.
+type vectorCollector struct{}
+
+func (vectorCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (vectorCollector) Collect(ch chan<- prometheus.Metric) {
+	sfxMetricsLock.RLock()
+	vecs := make([]prometheus.Collector, 0, len(sfxGauges)+len(sfxCounters)+len(sfxHistograms)+len(sfxSummaries))
+	for _, g := range sfxGauges {
+		vecs = append(vecs, g)
+	}
+	for _, c := range sfxCounters {
+		vecs = append(vecs, c)
+	}
+	for _, h := range sfxHistograms {
+		vecs = append(vecs, h)
+	}
+	for _, sm := range sfxSummaries {
+		vecs = append(vecs, sm)
+	}
+	sfxMetricsLock.RUnlock()
+	for _, vec := range vecs {
+		vec.Collect(ch)
+	}
+}
@@ -0,0 +1,109 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "signalfx-prometheus-exporter/utils"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchConfig calls onChange whenever the content of the config file changes.
+//
+// kubernetes updates mounted ConfigMaps by writing a new directory and swapping
+// the ..data symlink the config file points to, so the file itself never sees
+// an event. the directory of the file is watched instead, and the file is read
+// again through its symlinks on every event within it. only actual changes of
+// the content trigger onChange.
+func WatchConfig(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	checksum := configChecksum(path)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				Log().Errorf("Config watch failure: %+s", err)
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// the file is temporarily missing while it is replaced
+				current := configChecksum(path)
+				if current == nil || string(current) == string(checksum) {
+					continue
+				}
+				checksum = current
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
+
+// WaitForConfig polls until the config file exists and is not empty.
+//
+// mounted volumes can show up after the exporter started, e.g. when a sidecar
+// renders the config. without a timeout the file has to be there right away.
+func WaitForConfig(ctx context.Context, path string, timeout time.Duration, interval time.Duration) error {
+	if timeout <= 0 || configPresent(path) {
+		return nil
+	}
+	if interval <= 0 {
+		return fmt.Errorf("Config wait interval must be positive, got %v", interval)
+	}
+	Log().Infof("Waiting up to %v for config file %s", timeout, path)
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Config file %s did not appear within %v", path, timeout)
+		case <-ticker.C:
+			if configPresent(path) {
+				Log().Infof("Config file %s appeared after %v", path, time.Since(started).Round(time.Millisecond))
+				return nil
+			}
+		}
+	}
+}
+
+func configPresent(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > 0
+}
+
+func configChecksum(path string) []byte {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	content, err := ioutil.ReadFile(realPath)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(content)
+	return sum[:]
+}
@@ -0,0 +1,70 @@
+package serve_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"signalfx-prometheus-exporter/serve"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigMapVersion lays out a config version the way kubelet does for
+// mounted ConfigMaps and atomically points the ..data symlink to it
+func writeConfigMapVersion(t *testing.T, dir string, version string, content string) {
+	versionDir := filepath.Join(dir, "..2022_03_01_"+version)
+	assert.Nil(t, os.Mkdir(versionDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(versionDir, "config.yml"), []byte(content), 0644))
+	assert.Nil(t, os.Symlink(filepath.Base(versionDir), filepath.Join(dir, "..data_tmp")))
+	assert.Nil(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+}
+
+func TestWatchConfigFollowsConfigMapSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMapVersion(t, dir, "1", "flows: []")
+	configFile := filepath.Join(dir, "config.yml")
+	assert.Nil(t, os.Symlink(filepath.Join("..data", "config.yml"), configFile))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	assert.Nil(t, serve.WatchConfig(ctx, configFile, func() { changes <- struct{}{} }))
+
+	writeConfigMapVersion(t, dir, "2", "flows: [{}]")
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change was not detected")
+	}
+
+	// the same content again is no change
+	writeConfigMapVersion(t, dir, "3", "flows: [{}]")
+	select {
+	case <-changes:
+		t.Fatal("unchanged config was reported as change")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWaitForConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	ctx := context.Background()
+
+	// without a timeout, loading the config reports the missing file right away
+	assert.Nil(t, serve.WaitForConfig(ctx, path, 0, 0))
+	assert.NotNil(t, serve.WaitForConfig(ctx, path, 20*time.Millisecond, 5*time.Millisecond))
+
+	// an empty file is still being written
+	assert.Nil(t, ioutil.WriteFile(path, []byte{}, 0644))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ioutil.WriteFile(path, []byte("flows: []\n"), 0644)
+	}()
+	assert.Nil(t, serve.WaitForConfig(ctx, path, time.Second, 5*time.Millisecond))
+}
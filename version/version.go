@@ -0,0 +1,10 @@
+// Package version holds the build information of the exporter, which is set
+// with -ldflags "-X signalfx-prometheus-exporter/version.Version=..."
+package version
+
+var (
+	// Version is the released version, or the git description of the commit
+	Version = "unknown"
+	// Commit is the git commit the exporter was built from
+	Commit = "unknown"
+)